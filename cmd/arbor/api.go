@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// apiPrefix is the path beneath which the HTTP API is served.
+const apiPrefix = "/api/"
+
+// apiHandler serves a read-only JSON view of server's messages:
+//
+//	GET /api/rooms                   the names of the rooms
+//	GET /api/root                    the root message of a room
+//	GET /api/recent                  the IDs of a room's most recent messages
+//	GET /api/messages/<id>           a single message
+//	GET /api/messages/<id>/children  the direct replies to a message
+//	GET /api/messages/<id>/ancestry  a message followed by its ancestors,
+//	                                 nearest first (at most ?limit=N of them)
+//
+// The root and recent endpoints describe the default room unless another is
+// chosen with ?room=<name>.
+func apiHandler(server *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Allow", "GET, HEAD")
+			writeAPIError(w, http.StatusMethodNotAllowed, "Only GET requests are supported")
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, apiPrefix)
+		switch {
+		case path == "rooms":
+			writeJSON(w, http.StatusOK, server.rooms.Names())
+		case path == "root":
+			if room := apiRoom(w, r, server); room != nil {
+				writeAPIMessage(w, server, room.RootID)
+			}
+		case path == "recent":
+			if room := apiRoom(w, r, server); room != nil {
+				writeJSON(w, http.StatusOK, room.Recents.Data())
+			}
+		case strings.HasPrefix(path, "messages/"):
+			serveMessageAPI(w, r, server, strings.TrimPrefix(path, "messages/"))
+		default:
+			writeAPIError(w, http.StatusNotFound, "No such endpoint")
+		}
+	}
+}
+
+// serveMessageAPI handles the endpoints beneath /api/messages/, where path
+// is the remainder of the URL's path.
+func serveMessageAPI(w http.ResponseWriter, r *http.Request, server *Server, path string) {
+	id := path
+	endpoint := ""
+	if i := strings.Index(path, "/"); i >= 0 {
+		id, endpoint = path[:i], path[i+1:]
+	}
+	if id == "" {
+		writeAPIError(w, http.StatusNotFound, "No message ID given")
+		return
+	}
+	switch endpoint {
+	case "":
+		writeAPIMessage(w, server, id)
+	case "children":
+		results, ok := childMessages(server.store, server.children, id)
+		if !ok {
+			writeAPIError(w, http.StatusNotFound, "No message with id "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	case "ancestry":
+		limit := maxTreeQueryResults
+		if value := r.URL.Query().Get("limit"); value != "" {
+			requested, err := strconv.ParseUint(value, 10, 32)
+			if err != nil {
+				writeAPIError(w, http.StatusBadRequest, "Invalid limit "+value)
+				return
+			}
+			if requested > 0 && requested < maxTreeQueryResults {
+				limit = int(requested)
+			}
+		}
+		results := ancestry(server.store, id, limit)
+		if results == nil {
+			writeAPIError(w, http.StatusNotFound, "No message with id "+id)
+			return
+		}
+		writeJSON(w, http.StatusOK, results)
+	default:
+		writeAPIError(w, http.StatusNotFound, "No such endpoint")
+	}
+}
+
+// apiRoom returns the room chosen by the request. If there is no such room,
+// it responds with an error and returns nil.
+func apiRoom(w http.ResponseWriter, r *http.Request, server *Server) *Room {
+	name := r.URL.Query().Get("room")
+	if name == "" {
+		name = DefaultRoom
+	}
+	room := server.rooms.Get(name)
+	if room == nil {
+		writeAPIError(w, http.StatusNotFound, "No room named "+name)
+	}
+	return room
+}
+
+// writeAPIMessage responds with the message with the given id.
+func writeAPIMessage(w http.ResponseWriter, server *Server, id string) {
+	msg := server.store.Get(id)
+	if msg == nil {
+		writeAPIError(w, http.StatusNotFound, "No message with id "+id)
+		return
+	}
+	writeJSON(w, http.StatusOK, msg)
+}
+
+// writeAPIError responds with a JSON object describing an error.
+func writeAPIError(w http.ResponseWriter, status int, reason string) {
+	writeJSON(w, status, struct{ Error string }{reason})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Println("Error writing API response", err)
+	}
+}
@@ -1,24 +1,103 @@
 package main
 
 import (
+	"fmt"
 	"log"
 
 	"github.com/whereswaldon/arbor/lib/messages"
 )
 
+// SlowClientPolicy determines what a Broadcaster does when a client's queue
+// of outbound messages is full.
+type SlowClientPolicy int
+
+const (
+	// DropOldest discards the oldest message in the client's queue to make
+	// room for the new one.
+	DropOldest SlowClientPolicy = 0
+	// Disconnect removes the client and closes its connection.
+	Disconnect SlowClientPolicy = 1
+	// Block waits until the client's queue has room, delaying delivery to
+	// every other client until then. Messages are broadcast while holding the
+	// journal lock, so new messages are not accepted and new clients are not
+	// welcomed meanwhile either.
+	Block SlowClientPolicy = 2
+)
+
+// ParseSlowClientPolicy converts the name of a policy (as returned by
+// SlowClientPolicy.String) into a SlowClientPolicy.
+func ParseSlowClientPolicy(name string) (SlowClientPolicy, error) {
+	switch name {
+	case "drop-oldest":
+		return DropOldest, nil
+	case "disconnect":
+		return Disconnect, nil
+	case "block":
+		return Block, nil
+	}
+	return DropOldest, fmt.Errorf("Unknown slow client policy %q", name)
+}
+
+func (p SlowClientPolicy) String() string {
+	switch p {
+	case DropOldest:
+		return "drop-oldest"
+	case Disconnect:
+		return "disconnect"
+	case Block:
+		return "block"
+	}
+	return fmt.Sprintf("SlowClientPolicy(%d)", int(p))
+}
+
+// Client is a recipient of broadcast messages.
+type Client interface {
+	// Send delivers a message to the client, returning false if the client
+	// is no longer able to receive messages.
+	Send(*messages.ArborMessage) bool
+	// Close disconnects the client. It is called if the Broadcaster evicts
+	// the client for being too slow.
+	Close()
+}
+
 type Broadcaster struct {
 	send       chan *messages.ArborMessage
-	disconnect chan chan<- *messages.ArborMessage
-	connect    chan chan<- *messages.ArborMessage
-	clients    map[chan<- *messages.ArborMessage]struct{}
+	disconnect chan Client
+	drain      chan drainRequest
+	connect    chan *clientQueue
+	count      chan chan int
+	clients    map[Client]*clientQueue
+	queueSize  int
+	policy     SlowClientPolicy
+}
+
+// clientQueue holds the messages waiting to be delivered to a single client.
+type clientQueue struct {
+	client Client
+	queue  chan *messages.ArborMessage
+	// done is closed once messages are no longer being delivered to client
+	done chan struct{}
+}
+
+// drainRequest asks the Broadcaster to remove client and reply with the
+// channel that is closed once the client's queue has been delivered.
+type drainRequest struct {
+	client Client
+	reply  chan<- <-chan struct{}
 }
 
-func NewBroadcaster() *Broadcaster {
+// NewBroadcaster creates a Broadcaster that queues up to queueSize messages
+// for each client, and applies policy to clients whose queues are full.
+func NewBroadcaster(queueSize int, policy SlowClientPolicy) *Broadcaster {
 	b := &Broadcaster{
 		send:       make(chan *messages.ArborMessage),
-		connect:    make(chan chan<- *messages.ArborMessage),
-		disconnect: make(chan chan<- *messages.ArborMessage),
-		clients:    make(map[chan<- *messages.ArborMessage]struct{}),
+		connect:    make(chan *clientQueue),
+		disconnect: make(chan Client),
+		drain:      make(chan drainRequest),
+		count:      make(chan chan int),
+		clients:    make(map[Client]*clientQueue),
+		queueSize:  queueSize,
+		policy:     policy,
 	}
 	go b.dispatch()
 	return b
@@ -28,33 +107,121 @@ func (b *Broadcaster) dispatch() {
 	for {
 		select {
 		case message := <-b.send:
-			for client := range b.clients {
-				go b.trySend(message, client)
+			for _, client := range b.clients {
+				b.enqueue(message, client)
 			}
 		case newclient := <-b.connect:
-			b.clients[newclient] = struct{}{}
+			b.clients[newclient.client] = newclient
+			go newclient.deliver()
 
 		case deadclient := <-b.disconnect:
-			delete(b.clients, deadclient)
+			b.remove(deadclient)
+		case request := <-b.drain:
+			if queue, ok := b.clients[request.client]; ok {
+				b.remove(request.client)
+				request.reply <- queue.done
+			} else {
+				request.reply <- nil
+			}
+		case reply := <-b.count:
+			reply <- len(b.clients)
+		}
+	}
+}
+
+// enqueue adds message to the queue for client, applying the broadcaster's
+// policy if the queue is full.
+func (b *Broadcaster) enqueue(message *messages.ArborMessage, client *clientQueue) {
+	select {
+	case client.queue <- message:
+		return
+	case <-client.done:
+		b.remove(client.client)
+		return
+	default:
+	}
+	switch b.policy {
+	case DropOldest:
+		log.Println("Client queue full, dropping oldest message for ", client.client)
+		select {
+		case <-client.queue:
+		default:
+		}
+		select {
+		case client.queue <- message:
+		default:
 		}
+	case Disconnect:
+		log.Println("Client queue full, disconnecting ", client.client)
+		b.remove(client.client)
+		go client.client.Close()
+	case Block:
+		select {
+		case client.queue <- message:
+		case <-client.done:
+			b.remove(client.client)
+		}
+	}
+}
+
+// remove stops delivering messages to client. Any messages already in its
+// queue will still be delivered.
+func (b *Broadcaster) remove(client Client) {
+	queue, ok := b.clients[client]
+	if !ok {
+		return
 	}
+	delete(b.clients, client)
+	close(queue.queue)
 }
 
 func (b *Broadcaster) Send(message *messages.ArborMessage) {
 	b.send <- message
 }
 
-func (b *Broadcaster) trySend(message *messages.ArborMessage, client chan<- *messages.ArborMessage) {
-	defer func() {
-		if err := recover(); err != nil {
-			log.Println("Error sending to client, removing: ", err)
-			b.disconnect <- client
+// deliver sends each queued message to the client until the queue is closed
+// or the client stops accepting messages.
+func (c *clientQueue) deliver() {
+	defer close(c.done)
+	for message := range c.queue {
+		if !c.client.Send(message) {
+			log.Println("Client", c.client, "has gone away, no longer delivering to it")
+			return
 		}
-	}()
-	log.Println("trying send to ", client)
-	client <- message
+	}
 }
 
-func (b *Broadcaster) Add(client chan<- *messages.ArborMessage) {
-	b.connect <- client
+// Add begins delivering broadcast messages to client. If the broadcaster
+// disconnects the client because it is too slow, its Close method will be
+// called.
+func (b *Broadcaster) Add(client Client) {
+	b.connect <- &clientQueue{
+		client: client,
+		queue:  make(chan *messages.ArborMessage, b.queueSize),
+		done:   make(chan struct{}),
+	}
+}
+
+// Remove stops delivering broadcast messages to client. Removing a client
+// that was never added, or has already been removed, has no effect.
+func (b *Broadcaster) Remove(client Client) {
+	b.disconnect <- client
+}
+
+// Len returns the number of clients receiving broadcast messages.
+func (b *Broadcaster) Len() int {
+	reply := make(chan int)
+	b.count <- reply
+	return <-reply
+}
+
+// Drain stops delivering new broadcast messages to client, then waits until
+// every message already queued for it has been delivered (or the client has
+// stopped accepting them).
+func (b *Broadcaster) Drain(client Client) {
+	reply := make(chan (<-chan struct{}))
+	b.drain <- drainRequest{client: client, reply: reply}
+	if done := <-reply; done != nil {
+		<-done
+	}
 }
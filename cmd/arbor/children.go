@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sort"
+
+	"github.com/whereswaldon/arbor/lib/messages"
+)
+
+// ChildIndex maps the ID of each message to the IDs of its replies. It also
+// summarizes each subtree with a digest, so that two servers can compare
+// subtrees without comparing every message in them.
+type ChildIndex struct {
+	children map[string][]string
+	parents  map[string]string
+	// digests caches the digest of each subtree that has been summarized. If
+	// a subtree's digest is present, so are those of all of its descendants.
+	digests  map[string]string
+	add      chan *messages.Message
+	request  chan string
+	response chan []string
+	summary  chan summaryRequest
+}
+
+// SubtreeSummary describes the subtree beneath a message.
+type SubtreeSummary struct {
+	// Digest summarizes the message's ID and the IDs of all its descendants
+	Digest string
+	// Children maps the ID of each direct reply to the Digest of its subtree
+	Children map[string]string
+}
+
+type summaryRequest struct {
+	id    string
+	reply chan SubtreeSummary
+}
+
+func NewChildIndex() *ChildIndex {
+	c := &ChildIndex{
+		children: make(map[string][]string),
+		parents:  make(map[string]string),
+		digests:  make(map[string]string),
+		add:      make(chan *messages.Message),
+		request:  make(chan string),
+		response: make(chan []string),
+		summary:  make(chan summaryRequest),
+	}
+	go c.dispatch()
+	return c
+}
+
+func (c *ChildIndex) dispatch() {
+	for {
+		select {
+		case msg := <-c.add:
+			if _, exists := c.parents[msg.UUID]; exists {
+				continue
+			}
+			c.children[msg.Parent] = append(c.children[msg.Parent], msg.UUID)
+			c.parents[msg.UUID] = msg.Parent
+			c.invalidate(msg.Parent)
+		case id := <-c.request:
+			children := c.children[id]
+			res := make([]string, len(children))
+			copy(res, children)
+			c.response <- res
+		case request := <-c.summary:
+			summary := SubtreeSummary{
+				Digest:   c.digest(request.id),
+				Children: make(map[string]string),
+			}
+			for _, child := range c.children[request.id] {
+				summary.Children[child] = c.digest(child)
+			}
+			request.reply <- summary
+		}
+	}
+}
+
+// invalidate discards the cached digests of the subtrees containing the
+// message with the given id.
+func (c *ChildIndex) invalidate(id string) {
+	for id != "" {
+		if _, cached := c.digests[id]; !cached {
+			// nor are any of its ancestors
+			return
+		}
+		delete(c.digests, id)
+		id = c.parents[id]
+	}
+}
+
+// digest returns the digest of the subtree beneath the message with the
+// given id, which is the hash of its id followed by the sorted digests of its
+// children's subtrees. It does not depend on the order in which the messages
+// were added.
+func (c *ChildIndex) digest(id string) string {
+	if digest, cached := c.digests[id]; cached {
+		return digest
+	}
+	children := c.children[id]
+	childDigests := make([]string, len(children))
+	for i, child := range children {
+		childDigests[i] = c.digest(child)
+	}
+	sort.Strings(childDigests)
+	hash := sha256.New()
+	hash.Write([]byte(id))
+	for _, childDigest := range childDigests {
+		hash.Write([]byte{'\n'})
+		hash.Write([]byte(childDigest))
+	}
+	digest := hex.EncodeToString(hash.Sum(nil))
+	c.digests[id] = digest
+	return digest
+}
+
+// Add records msg as a child of its parent. Adding a message that is already
+// recorded has no effect.
+func (c *ChildIndex) Add(msg *messages.Message) {
+	c.add <- msg
+}
+
+// Children returns the IDs of every known reply to the message with the given
+// id, in the order that they were added.
+func (c *ChildIndex) Children(id string) []string {
+	c.request <- id
+	return <-c.response
+}
+
+// Summarize returns the digest of the subtree beneath the message with the
+// given id, along with the digests of the subtrees beneath each of its
+// replies.
+func (c *ChildIndex) Summarize(id string) SubtreeSummary {
+	reply := make(chan SubtreeSummary)
+	c.summary <- summaryRequest{id: id, reply: reply}
+	return <-reply
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"sync"
+)
+
+// journalBatchSize is the largest number of entries returned by a single
+// call to Journal.After.
+const journalBatchSize = 1024
+
+// Journal records the order in which the server accepted its messages. The
+// message accepted first has sequence number 1, and each later message has
+// the next number, so followers can copy the messages in the same order and
+// ask for everything after the last one they have.
+//
+// Its lock must be held while a message is stored, recorded and broadcast, so
+// that the journal's order matches the store's, a reply is never recorded
+// before the message that it replies to, and clients receive new messages in
+// the order of their sequence numbers.
+type Journal struct {
+	ids  []string
+	seqs map[string]uint64
+	// grew is closed, and replaced, whenever a message is recorded
+	grew chan struct{}
+	sync.Mutex
+}
+
+func NewJournal() *Journal {
+	return &Journal{
+		seqs: make(map[string]uint64),
+		grew: make(chan struct{}),
+	}
+}
+
+// Record appends the message with the given id, unless it is already
+// present, and returns its sequence number. The caller must hold the lock.
+func (j *Journal) Record(id string) uint64 {
+	if seq, ok := j.seqs[id]; ok {
+		return seq
+	}
+	j.ids = append(j.ids, id)
+	seq := uint64(len(j.ids))
+	j.seqs[id] = seq
+	close(j.grew)
+	j.grew = make(chan struct{})
+	return seq
+}
+
+// Last returns the sequence number of the most recently recorded message, or
+// zero if there is none.
+func (j *Journal) Last() uint64 {
+	j.Lock()
+	defer j.Unlock()
+	return j.last()
+}
+
+// last is Last for callers that already hold the lock.
+func (j *Journal) last() uint64 {
+	return uint64(len(j.ids))
+}
+
+// After returns the IDs of up to journalBatchSize of the messages recorded
+// after the one with sequence number seq, in order, along with a channel that
+// is closed when another message is recorded.
+func (j *Journal) After(seq uint64) ([]string, <-chan struct{}) {
+	j.Lock()
+	defer j.Unlock()
+	if seq >= uint64(len(j.ids)) {
+		return nil, j.grew
+	}
+	end := uint64(len(j.ids))
+	if end-seq > journalBatchSize {
+		end = seq + journalBatchSize
+	}
+	ids := make([]string, end-seq)
+	copy(ids, j.ids[seq:end])
+	return ids, j.grew
+}
+
+// ID returns the ID of the message with sequence number seq, or "" if there
+// is none.
+func (j *Journal) ID(seq uint64) string {
+	j.Lock()
+	defer j.Unlock()
+	if seq == 0 || seq > uint64(len(j.ids)) {
+		return ""
+	}
+	return j.ids[seq-1]
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// Keepalive configures how the server notices clients that have disconnected
+// without closing their connections.
+type Keepalive struct {
+	// Interval is how often each client is checked. A client that has sent
+	// nothing for an Interval is sent a PING. Zero disables both pings and
+	// the idle timeout.
+	Interval time.Duration
+	// Timeout is how long a client may send nothing before it is disconnected.
+	Timeout time.Duration
+}
+
+// writeTimeout returns how long a client may take to accept each message. A
+// client that cannot accept one within the idle timeout is disconnected just
+// like one that has stopped sending, so that waiting to write to it never
+// keeps it connected for longer.
+func (k Keepalive) writeTimeout() time.Duration {
+	if k.Interval > 0 && k.Timeout < writeTimeout {
+		return k.Timeout
+	}
+	return writeTimeout
+}
+
+// ticker returns a channel on which the client should be checked, and a
+// function that releases it. The channel is nil if keepalives are disabled.
+func (k Keepalive) ticker() (<-chan time.Time, func()) {
+	if k.Interval <= 0 {
+		return nil, func() {}
+	}
+	t := time.NewTicker(k.Interval)
+	return t.C, t.Stop
+}
+
+// check pings a client that was last heard from at lastHeard if it has been
+// quiet, and returns false if it has been quiet for so long that it should be
+// disconnected. Clients using a protocol version without PING are left alone,
+// since they have no way to show that they are still there.
+//
+// The PING is dropped if the client is not accepting messages, since waiting
+// for a client that has silently gone away would prevent it from ever being
+// disconnected.
+func (k Keepalive) check(client *Session, lastHeard time.Time) bool {
+	if !client.Version().Supports(PING) {
+		return true
+	}
+	idle := time.Since(lastHeard)
+	if idle >= k.Timeout {
+		log.Println("Disconnecting", client, "after", idle.Round(time.Second), "without a message")
+		return false
+	}
+	k.extend(client, lastHeard)
+	if idle >= k.Interval {
+		client.TrySend(&ArborMessage{Type: PING})
+	}
+	return true
+}
+
+// extend sets the deadline by which a client that was last heard from at
+// lastHeard must send something, after which reading from it fails. This
+// disconnects the client even if its session is too busy to check it.
+func (k Keepalive) extend(client *Session, lastHeard time.Time) {
+	if k.Interval <= 0 || !client.Version().Supports(PING) {
+		return
+	}
+	client.SetReadDeadline(lastHeard.Add(k.Timeout))
+}
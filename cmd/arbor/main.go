@@ -1,98 +1,609 @@
 package main
 
 import (
+	"crypto/subtle"
+	"flag"
+	"fmt"
 	"log"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 
 	. "github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
 )
 
 func main() {
-	messages := NewStore()
-	broadcaster := NewBroadcaster()
-	recents := NewRecents(10)
+	children := NewChildIndex()
 	address := ":7777"
-	//serve
-	if (len(os.Args) > 1) {
-    		address = os.Args[1]
+	framingName := flag.String("framing", NewlineFraming.String(), "message framing to use on client connections (newline or length)")
+	storePath := flag.String("store", "", "file in which to save messages (messages are only kept in memory if empty)")
+	queueSize := flag.Int("queue-size", 64, "number of broadcast messages that may wait to be sent to each client")
+	policyName := flag.String("slow-client", DropOldest.String(), "what to do when a client's queue is full (drop-oldest, disconnect, or block, which also stalls new messages and new clients until it catches up)")
+	httpAddress := flag.String("http", "", "address on which to accept WebSocket connections at /ws (disabled if empty)")
+	roomList := flag.String("rooms", "", "comma-separated names of rooms to create in addition to the default room")
+	serveAPI := flag.Bool("api", false, "serve a read-only JSON API under /api/ on the -http address")
+	shutdownTimeout := flag.Duration("shutdown-timeout", 10*time.Second, "how long to wait for clients to receive pending messages when shutting down")
+	maxContent := flag.Int("max-content", defaultMaxContentLength, "longest permitted message content, in bytes")
+	maxUsername := flag.Int("max-username", defaultMaxUsernameLength, "longest permitted username, in bytes")
+	maxClockSkew := flag.Duration("max-clock-skew", defaultMaxClockSkew, "how far in the future a new message's timestamp may be")
+	maxAge := flag.Duration("max-message-age", defaultMaxAge, "how far in the past a new message's timestamp may be (unlimited if 0)")
+	postRate := flag.Float64("post-rate", 1, "new messages per second allowed from each connection (unlimited if 0)")
+	postBurst := flag.Int("post-burst", 10, "new messages that each connection may send at once after a quiet period")
+	queryRate := flag.Float64("query-rate", 50, "queries per second allowed from each connection (unlimited if 0)")
+	queryBurst := flag.Int("query-burst", 200, "queries that each connection may send at once after a quiet period")
+	sharedFactor := flag.Float64("shared-rate-factor", 4, "multiple of the per-connection rates shared by each remote address and each username")
+	maxInFlight := flag.Int("max-in-flight", 32, "requests from each connection that may be handled at once (unlimited if 0)")
+	maxThrottled := flag.Int("max-throttled", 10, "throttled requests per minute after which a connection is closed (never closed if 0)")
+	pingInterval := flag.Duration("ping-interval", 30*time.Second, "how long a client may be quiet before it is sent a PING (disabled if 0)")
+	idleTimeout := flag.Duration("idle-timeout", 90*time.Second, "how long a client may be quiet before it is disconnected")
+	upstreamAddress := flag.String("upstream", "", "address of another arbor server whose rooms should be mirrored (disabled if empty)")
+	upstreamFraming := flag.String("upstream-framing", NewlineFraming.String(), "message framing used by the -upstream server (newline or length)")
+	serverID := flag.String("server-id", "", "identifier that marks the messages this server relays (random if empty)")
+	followAddress := flag.String("follow", "", "address of a primary arbor server to keep a read-only copy of (disabled if empty)")
+	followFraming := flag.String("follow-framing", NewlineFraming.String(), "message framing used by the -follow server (newline or length)")
+	peerToken := flag.String("peer-token", "", "secret shared by arbor servers that relay to or replicate from each other, which are not rate limited (disabled if empty)")
+	tlsConfig := transport.AddServerFlags(flag.CommandLine)
+	upstreamTLS := transport.AddPrefixedClientFlags(flag.CommandLine, "upstream-")
+	followTLS := transport.AddPrefixedClientFlags(flag.CommandLine, "follow-")
+	flag.Parse()
+	framing, err := ParseFraming(*framingName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	policy, err := ParseSlowClientPolicy(*policyName)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *queueSize < 1 {
+		log.Fatal("Queue size must be at least 1")
+	}
+	if *maxContent < 1 || *maxUsername < 0 {
+		log.Fatal("Content limit must be at least 1 and username limit must not be negative")
+	}
+	if (*postRate > 0 && *postBurst < 1) || (*queryRate > 0 && *queryBurst < 1) {
+		log.Fatal("Bursts must be at least 1 when rates are limited")
+	}
+	if *postRate < 0 || *queryRate < 0 || *sharedFactor < 1 || *maxInFlight < 0 || *maxThrottled < 0 {
+		log.Fatal("Rate limits must not be negative, and the shared rate factor must be at least 1")
+	}
+	if *pingInterval > 0 && *idleTimeout <= *pingInterval {
+		log.Fatal("The idle timeout must be longer than the ping interval")
+	}
+	if *serverID == "" {
+		if *serverID, err = newServerID(); err != nil {
+			log.Fatal(err)
+		}
 	}
-	listener, err := net.Listen("tcp", address)
+	if *followAddress != "" && (*upstreamAddress != "" || *roomList != "") {
+		log.Fatal("A follower copies its primary's rooms, so it cannot use -upstream or -rooms")
+	}
+	if *serveAPI && *httpAddress == "" {
+		log.Fatal("The API requires an -http address")
+	}
+	roomNames, err := parseRoomNames(*roomList)
 	if err != nil {
 		log.Fatal(err)
 	}
-	log.Println("Server listening on", address)
-	m, err := NewMessage("Root message")
-	err = m.AssignID()
+	rooms := NewRooms(*queueSize, policy)
+	messages, err := openStore(*storePath)
 	if err != nil {
-		log.Println(err)
+		log.Fatal(err)
 	}
-	messages.Add(m)
-	toWelcome := make(chan chan<- *ArborMessage)
-	go handleWelcomes(m.UUID, recents, toWelcome)
-	log.Println("Root message UUID is " + m.UUID)
-	for {
-		conn, err := listener.Accept()
+	journal := NewJournal()
+	//serve
+	if flag.NArg() > 0 {
+		address = flag.Arg(0)
+	}
+	listener, err := transport.Listen(address, tlsConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Server listening on", address, "using", framing, "framing")
+	var upstream *Upstream
+	if *upstreamAddress != "" {
+		framing, err := ParseFraming(*upstreamFraming)
 		if err != nil {
-			log.Println(err)
+			log.Fatal(err)
 		}
-		fromClient := MakeMessageReader(conn)
-		toClient := MakeMessageWriter(conn)
-		broadcaster.Add(toClient)
-		go handleClient(fromClient, toClient, recents, messages, broadcaster)
-		toWelcome <- toClient
+		upstream = NewUpstream(*upstreamAddress, upstreamTLS, framing, *serverID, *peerToken, rooms, messages, children, journal)
+	}
+	if err := restoreRooms(messages, children, journal, rooms, upstream); err != nil {
+		log.Fatal(err)
 	}
+	var follower *Follower
+	if *followAddress != "" {
+		framing, err := ParseFraming(*followFraming)
+		if err != nil {
+			log.Fatal(err)
+		}
+		follower = NewFollower(*followAddress, followTLS, framing, *peerToken, rooms, messages, children, journal)
+		// the primary's rooms are replicated instead of being created here
+		if err := follower.Connect(); err != nil {
+			log.Fatal(err)
+		}
+	} else {
+		// an edge server's default room is its upstream server's
+		if upstream == nil {
+			roomNames = append([]string{DefaultRoom}, roomNames...)
+		}
+		if err := createRooms(messages, journal, rooms, roomNames); err != nil {
+			log.Fatal(err)
+		}
+	}
+	for _, name := range rooms.Names() {
+		log.Println("Root message UUID of room", name, "is", rooms.Get(name).RootID)
+	}
+	validator := NewValidator(messages)
+	validator.MaxContentLength = *maxContent
+	validator.MaxUsernameLength = *maxUsername
+	validator.MaxClockSkew = *maxClockSkew
+	validator.MaxAge = *maxAge
+	validator.ServerID = *serverID
+	validator.Follower = follower
+	limits := NewRateLimiter(RateLimits{
+		Posts:        Rate{PerSecond: *postRate, Burst: *postBurst},
+		Queries:      Rate{PerSecond: *queryRate, Burst: *queryBurst},
+		SharedFactor: *sharedFactor,
+		MaxInFlight:  *maxInFlight,
+		MaxThrottled: *maxThrottled,
+	})
+	keepalive := Keepalive{Interval: *pingInterval, Timeout: *idleTimeout}
+	server := NewServer(rooms, messages, children, journal, validator, limits, keepalive, *peerToken)
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	var httpServer *http.Server
+	if *httpAddress != "" {
+		httpListener, err := transport.Listen(*httpAddress, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		mux := http.NewServeMux()
+		mux.Handle("/ws", webSocketHandler(server))
+		if *serveAPI {
+			mux.Handle(apiPrefix, apiHandler(server))
+			log.Println("Serving API at", *httpAddress+apiPrefix)
+		}
+		httpServer = &http.Server{Handler: mux}
+		go func() {
+			if err := httpServer.Serve(httpListener); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+		log.Println("Accepting WebSocket connections at", *httpAddress+"/ws")
+	}
+	if upstream != nil {
+		go upstream.Run()
+	}
+	if follower != nil {
+		go follower.Run()
+		promote := make(chan os.Signal, 1)
+		signal.Notify(promote, syscall.SIGUSR1)
+		go func() {
+			<-promote
+			follower.Promote()
+		}()
+	}
+	stopping := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				select {
+				case <-stopping:
+					return
+				default:
+				}
+				log.Println(err)
+				continue
+			}
+			server.Serve(conn, framing)
+		}
+	}()
+
+	sig := <-signals
+	log.Println("Received", sig, "shutting down")
+	close(stopping)
+	listener.Close()
+	if httpServer != nil {
+		// connections that have become WebSocket sessions are not closed
+		httpServer.Close()
+	}
+	server.Shutdown(*shutdownTimeout)
+	if err := closeStore(messages); err != nil {
+		log.Fatal(err)
+	}
+	log.Println("Shutdown complete")
 }
 
-func handleWelcomes(rootId string, recents *RecentList, toWelcome chan chan<- *ArborMessage) {
-	for client := range toWelcome {
-		msg := ArborMessage{
-			Type:  WELCOME,
-			Root:  rootId,
-			Major: 0,
-			Minor: 1,
+// parseRoomNames splits a comma-separated list of room names.
+func parseRoomNames(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	names := strings.Split(list, ",")
+	for _, name := range names {
+		if name == "" {
+			return nil, fmt.Errorf("Room names must not be empty")
 		}
-		msg.Recent = recents.Data()
+	}
+	return names, nil
+}
 
-		client <- &msg
-		log.Println("Welcome message: ", msg.String())
+// restoreRooms rebuilds the tree from the messages already in the store and
+// then, if upstream is set, connects to the upstream server and adopts its
+// rooms, which may have been mirrored before the server was restarted. The
+// upstream rooms should exist before local ones are created, but if the
+// upstream server cannot be reached, they are adopted once Run reaches it.
+func restoreRooms(store Store, children *ChildIndex, journal *Journal, rooms *Rooms, upstream *Upstream) error {
+	if err := restoreTree(store, children, journal, rooms); err != nil {
+		return err
+	}
+	if upstream == nil {
+		return nil
+	}
+	if err := upstream.Connect(); err != nil {
+		log.Println("Unable to connect to upstream server:", err)
+	}
+	return nil
+}
 
+// welcome creates the WELCOME message sent to each new client, which
+// describes the room that the client is placed in. It should be created once
+// the client has joined the room, so that the client is sent every message
+// newer than the one whose sequence number it carries.
+func welcome(room *Room, rooms *Rooms, journal *Journal) *ArborMessage {
+	version := CurrentVersion()
+	return &ArborMessage{
+		Type:   WELCOME,
+		Root:   room.RootID,
+		Recent: room.Recents.Data(),
+		Major:  version.Major,
+		Minor:  version.Minor,
+		Room:   room.Name,
+		Rooms:  rooms.Names(),
+		Seq:    journal.Last(),
 	}
 }
 
-func handleClient(from <-chan *ArborMessage, to chan<- *ArborMessage, recents *RecentList, store *Store, broadcaster *Broadcaster) {
-	for message := range from {
+// handleClient welcomes the client to the default room and then answers its
+// messages until it disconnects, sends something undecodable, exceeds its
+// rate limits too often, or stays silent for longer than the keepalive
+// timeout, at which point the session is finished. A client that sends
+// peerToken in a PEER request is another server, and is not rate limited.
+func handleClient(client *Session, rooms *Rooms, store Store, children *ChildIndex, journal *Journal, validator *Validator, limits *RateLimiter, keepalive Keepalive, peerToken string) {
+	defer client.Finish()
+	room := rooms.Default()
+	if room == nil {
+		// an edge server has no rooms until it reaches its upstream server
+		client.Send(NewError(ERR_INTERNAL, "Server has not yet received its rooms from its upstream server", ""))
+		return
+	}
+	limiter := limits.ForClient(client.RemoteAddr())
+	peer, replicating := false, false
+	// handle answers a request concurrently, within the client's limit on
+	// requests in progress unless it is a peer
+	handle := func(f func()) {
+		if peer {
+			go f()
+		} else {
+			limiter.Go(f)
+		}
+	}
+	checks, stopChecks := keepalive.ticker()
+	defer stopChecks()
+	lastHeard := time.Now()
+	client.Join(room.Broadcaster)
+	msg := welcome(room, rooms, journal)
+	client.Send(msg)
+	log.Println("Welcome message: ", msg.String())
+	for {
+		var message *ArborMessage
+		select {
+		case m, ok := <-client.Messages():
+			if !ok {
+				return
+			}
+			message = m
+		case <-checks:
+			if !keepalive.check(client, lastHeard) {
+				return
+			}
+			continue
+		}
+		lastHeard = time.Now()
+		keepalive.extend(client, lastHeard)
+		if requiresMessage(message.Type) && message.Message == nil {
+			client.Send(errorResponse(message, ERR_MALFORMED, fmt.Sprintf("Message of type %d has no message fields", message.Type), ""))
+			continue
+		}
+		if reason := throttle(message, limiter, peer); reason != "" {
+			if !limiter.Throttled() {
+				log.Println("Disconnecting", client, "for exceeding rate limits")
+				client.Send(errorResponse(message, ERR_RATE_LIMITED, reason+", disconnecting", ""))
+				return
+			}
+			client.Send(errorResponse(message, ERR_RATE_LIMITED, reason, ""))
+			continue
+		}
 		switch message.Type {
 		case QUERY:
 			log.Println("Handling query for " + message.Message.UUID)
-			go handleQuery(message, to, store)
+			handle(func() { handleQuery(message, client, store) })
+		case ANCESTRY:
+			handle(func() { handleAncestry(message, client, store) })
+		case CHILDREN:
+			handle(func() { handleChildren(message, client, store, children) })
+		case SUBTREE:
+			handle(func() { handleSubtree(message, client, store, children) })
+		case SYNC:
+			handle(func() { handleSync(message, client, store, children) })
 		case NEW_MESSAGE:
-			go handleNewMessage(message, recents, store, broadcaster)
+			if peer {
+				// handled synchronously, since a peer relays each message
+				// after the one that it replies to
+				handleNewMessage(message, client, rooms, store, children, journal, validator)
+				break
+			}
+			// an ordinary client could claim that its message was relayed
+			// to escape the limit on its age
+			message.Via = nil
+			handle(func() { handleNewMessage(message, client, rooms, store, children, journal, validator) })
+		case REPLICATE:
+			// it lasts as long as the session, so it would hold one of the
+			// client's requests in progress forever, but only one is allowed
+			if replicating {
+				client.Send(errorResponse(message, ERR_NOT_PERMITTED, "Already replicating to this client", ""))
+				continue
+			}
+			replicating = true
+			go handleReplicate(message, client, store, journal)
+		case VERSION:
+			// handled synchronously so that no later message is answered
+			// before the client knows which version is in use
+			handleVersion(message, client)
+		case RESUME:
+			handle(func() { handleResume(message, client, rooms, store, journal) })
+		case JOIN:
+			handleJoin(message, client, rooms, journal)
+		case LEAVE:
+			handleLeave(message, client, rooms)
+		case LIST_ROOMS:
+			client.Send(&ArborMessage{
+				Type:      LIST_ROOMS,
+				RequestID: message.RequestID,
+				Rooms:     rooms.Names(),
+			})
+		case PEER:
+			peer = handlePeer(message, client, peerToken)
+		case PING:
+			client.Send(&ArborMessage{
+				Type:      PONG,
+				RequestID: message.RequestID,
+			})
+		case PONG:
+			// receiving it has already shown that the client is still there
 		default:
 			log.Println("Unrecognized message type", message.Type)
+			client.Send(errorResponse(message, ERR_UNKNOWN_TYPE, fmt.Sprintf("Unrecognized message type %d", message.Type), ""))
 			continue
 		}
 	}
 }
 
-func handleQuery(msg *ArborMessage, out chan<- *ArborMessage, store *Store) {
+// requiresMessage returns whether protocol messages of type t must carry
+// the fields of a chat message.
+func requiresMessage(t ArborMessageType) bool {
+	switch t {
+	case QUERY, NEW_MESSAGE, ANCESTRY, CHILDREN, SUBTREE, SYNC:
+		return true
+	}
+	return false
+}
+
+// throttle returns why message must be refused under the client's rate
+// limits, or "" if it may be handled. Requests that are handled concurrently
+// reserve a slot with limiter.Begin when they are allowed. Peers are not
+// limited, as they relay and synchronize on behalf of all of their clients.
+func throttle(message *ArborMessage, limiter *ClientLimiter, peer bool) string {
+	if peer {
+		return ""
+	}
+	switch message.Type {
+	case NEW_MESSAGE:
+		if !limiter.AllowPost(message.Message.Username) {
+			return "Too many new messages"
+		}
+	case QUERY, ANCESTRY, CHILDREN, SUBTREE, SYNC, RESUME:
+		if !limiter.AllowQuery() {
+			return "Too many queries"
+		}
+	default:
+		return ""
+	}
+	if !limiter.Begin() {
+		return "Too many requests in progress"
+	}
+	return ""
+}
+
+// errorResponse creates an ERROR message in response to request.
+func errorResponse(request *ArborMessage, code ErrorCode, reason, id string) *ArborMessage {
+	e := NewError(code, reason, id)
+	e.RequestID = request.RequestID
+	return e
+}
+
+func handleVersion(msg *ArborMessage, client *Session) {
+	chosen, ok := Negotiate(msg.Versions)
+	if !ok {
+		log.Println("Rejecting client offering versions", msg.Versions)
+		client.Send(&ArborMessage{
+			Type:   VERSION,
+			Reason: fmt.Sprintf("none of the offered versions %v are supported, server supports %v", msg.Versions, SupportedVersions),
+		})
+		return
+	}
+	client.Send(&ArborMessage{
+		Type:  VERSION,
+		Major: chosen.Major,
+		Minor: chosen.Minor,
+	})
+}
+
+// handlePeer replies to a PEER request, and returns whether the client sent
+// the correct token and so is a peer server.
+func handlePeer(msg *ArborMessage, client *Session, peerToken string) bool {
+	if peerToken == "" || subtle.ConstantTimeCompare([]byte(msg.Token), []byte(peerToken)) != 1 {
+		log.Println("Refusing peer request from", client)
+		client.Send(errorResponse(msg, ERR_NOT_PERMITTED, "Incorrect peer token", ""))
+		return false
+	}
+	log.Println("Accepted", client, "as a peer server")
+	client.Send(&ArborMessage{
+		Type:      PEER,
+		RequestID: msg.RequestID,
+	})
+	return true
+}
+
+// handleJoin adds the client to the requested room, and replies with the
+// room's root and recent messages.
+func handleJoin(msg *ArborMessage, client *Session, rooms *Rooms, journal *Journal) {
+	room := rooms.Get(msg.Room)
+	if room == nil {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ROOM, "No room named "+msg.Room, ""))
+		return
+	}
+	client.Join(room.Broadcaster)
+	client.Send(&ArborMessage{
+		Type:      JOIN,
+		RequestID: msg.RequestID,
+		Room:      room.Name,
+		Root:      room.RootID,
+		Recent:    room.Recents.Data(),
+		Seq:       journal.Last(),
+	})
+}
+
+// handleLeave removes the client from the requested room.
+func handleLeave(msg *ArborMessage, client *Session, rooms *Rooms) {
+	room := rooms.Get(msg.Room)
+	if room == nil {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ROOM, "No room named "+msg.Room, ""))
+		return
+	}
+	client.Leave(room.Broadcaster)
+	client.Send(&ArborMessage{
+		Type:      LEAVE,
+		RequestID: msg.RequestID,
+		Room:      room.Name,
+	})
+}
+
+// handleResume sends up to msg.Limit of the messages in the requested room
+// that were accepted after the one with sequence number msg.Seq, in order,
+// followed by a DONE with the sequence number of the last message examined.
+// A client that has been disconnected uses it to fetch what it missed.
+func handleResume(msg *ArborMessage, client *Session, rooms *Rooms, store Store, journal *Journal) {
+	room := rooms.Get(msg.Room)
+	if room == nil {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ROOM, "No room named "+msg.Room, ""))
+		return
+	}
+	limit := int(msg.Limit)
+	if limit <= 0 || limit > maxTreeQueryResults {
+		limit = maxTreeQueryResults
+	}
+	seq, sent := msg.Seq, 0
+	for sent < limit {
+		ids, _ := journal.After(seq)
+		if len(ids) == 0 {
+			break
+		}
+		for _, id := range ids {
+			seq++
+			if rooms.Of(id) != room {
+				continue
+			}
+			missed := store.Get(id)
+			if missed == nil {
+				log.Println("Unable to find message", id, "to resume from")
+				continue
+			}
+			client.Send(&ArborMessage{
+				Type:      NEW_MESSAGE,
+				RequestID: msg.RequestID,
+				Room:      room.Name,
+				Seq:       seq,
+				Message:   missed,
+			})
+			if sent++; sent == limit {
+				break
+			}
+		}
+	}
+	client.Send(&ArborMessage{
+		Type:      DONE,
+		RequestID: msg.RequestID,
+		Room:      room.Name,
+		Seq:       seq,
+	})
+}
+
+func handleQuery(msg *ArborMessage, client *Session, store Store) {
 	result := store.Get(msg.Message.UUID)
 	if result == nil {
 		log.Println("Unable to find queried id: " + msg.Message.UUID)
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ID, "No message with id "+msg.Message.UUID, msg.Message.UUID))
 		return
 	}
 	msg.Message = result
 	msg.Type = NEW_MESSAGE
-	out <- msg
+	client.Send(msg)
 	log.Println("Query response: ", msg.String())
 }
 
-func handleNewMessage(msg *ArborMessage, recents *RecentList, store *Store, broadcaster *Broadcaster) {
-	err := msg.Message.AssignID()
-	if err != nil {
-		log.Println("Error creating new message", err)
+func handleNewMessage(msg *ArborMessage, client *Session, rooms *Rooms, store Store, children *ChildIndex, journal *Journal, validator *Validator) {
+	if r := validator.Validate(msg); r != nil {
+		log.Println("Rejecting new message:", r.reason)
+		client.Send(errorResponse(msg, r.code, r.reason, r.id))
+		return
+	}
+	msg.Message.AssignHashID()
+	// the validator has checked that the parent exists
+	msg.Message.Depth = store.Get(msg.Message.Parent).Depth + 1
+	journal.Lock()
+	if existing := store.Get(msg.Message.UUID); existing != nil {
+		journal.Unlock()
+		// an identical message has already been accepted, so there is nothing
+		// new to tell the other clients
+		log.Println("Ignoring duplicate message", msg.Message.UUID)
+		msg.Message = existing
+		client.Send(msg)
+		return
+	}
+	if err := store.Add(msg.Message); err != nil {
+		journal.Unlock()
+		log.Println("Error storing new message", err)
+		client.Send(errorResponse(msg, ERR_INTERNAL, "Unable to store message", ""))
+		return
+	}
+	msg.Seq = journal.Record(msg.Message.UUID)
+	// the request id is only meaningful to the sender, not to the clients
+	// receiving the broadcast
+	msg.RequestID = ""
+	children.Add(msg.Message)
+	if room := rooms.Add(msg.Message); room != nil {
+		msg.Room = room.Name
+		msg.Prev = room.Next(msg.Seq)
+		room.Broadcaster.Send(msg)
+	} else {
+		// nobody can be in the room, so only the sender needs a reply
+		client.Send(msg)
 	}
-	recents.Add(msg.Message.UUID)
-	store.Add(msg.Message)
-	broadcaster.Send(msg)
+	journal.Unlock()
 }
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"net"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
+)
+
+// peerRequestID is the RequestID of the PEER request sent by dialPeer.
+const peerRequestID = "peer"
+
+// peerConn is a connection to another arbor server, to which this server is
+// a client.
+type peerConn struct {
+	conn      net.Conn
+	codec     *Codec
+	requester *Requester
+	// in delivers the messages from the other server once the handshake is
+	// complete
+	in      <-chan *ArborMessage
+	welcome *ArborMessage
+}
+
+// dialPeer connects to the arbor server at address and agrees on protocol
+// version 0.2, which is needed for rooms, tree queries and replication. If
+// token is not empty, it is sent in a PEER request so that the other server
+// treats the connection as coming from a peer server rather than a client.
+func dialPeer(address string, config *transport.ClientConfig, framing Framing, token string) (*peerConn, error) {
+	conn, err := transport.Dial(address, config)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to connect to server %s", address)
+	}
+	return newPeerConn(conn, address, framing, token)
+}
+
+// newPeerConn performs the handshake described by dialPeer over conn, which
+// is closed if it fails.
+func newPeerConn(conn net.Conn, address string, framing Framing, token string) (*peerConn, error) {
+	p := &peerConn{
+		conn:  conn,
+		codec: NewCodec(framing),
+	}
+	p.requester = NewRequester(p.codec.MakeWriter(conn))
+	p.in = p.codec.MakeReader(conn)
+	conn.SetDeadline(time.Now().Add(requestTimeout))
+	p.requester.Send(&ArborMessage{
+		Type:     VERSION,
+		Versions: SupportedVersions,
+	})
+	// the handshake is read here rather than through the requester, so the
+	// PEER request has a fixed ID
+	sentToken, accepted := false, token == ""
+	for p.welcome == nil || !p.codec.Version().Supports(JOIN) || !accepted {
+		msg, ok := <-p.in
+		if !ok {
+			conn.Close()
+			return nil, errors.Errorf("Server %s closed the connection before agreeing on protocol version %s", address, Version0_2)
+		}
+		switch msg.Type {
+		case WELCOME:
+			p.welcome = msg
+		case VERSION:
+			if msg.IsVersionRejection() {
+				conn.Close()
+				return nil, errors.Errorf("Server %s refused protocol versions: %s", address, msg.Reason)
+			}
+		case PEER:
+			accepted = msg.RequestID == peerRequestID
+		case ERROR:
+			if msg.RequestID == peerRequestID {
+				conn.Close()
+				return nil, errors.Errorf("Server %s refused the peer token: %s", address, msg.Reason)
+			}
+		}
+		if !sentToken && !accepted && p.codec.Version().Supports(PEER) {
+			sentToken = true
+			p.requester.Send(&ArborMessage{
+				Type:      PEER,
+				RequestID: peerRequestID,
+				Token:     token,
+			})
+		}
+	}
+	conn.SetDeadline(time.Time{})
+	return p, nil
+}
+
+// pong answers a PING from the other server.
+func (p *peerConn) pong(ping *ArborMessage) {
+	// sent from another goroutine so that reading never waits for writing
+	go p.requester.Send(&ArborMessage{
+		Type:      PONG,
+		RequestID: ping.RequestID,
+	})
+}
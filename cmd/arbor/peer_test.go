@@ -0,0 +1,139 @@
+package main
+
+import (
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// testClient is a connection to a test server that has agreed on the newest
+// protocol version.
+type testClient struct {
+	t       *testing.T
+	conn    net.Conn
+	in      <-chan *ArborMessage
+	out     chan<- *ArborMessage
+	welcome *ArborMessage
+}
+
+func newTestClient(t *testing.T, server *Server) *testClient {
+	conn, client := net.Pipe()
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.Serve(conn, NewlineFraming)
+	codec := NewCodec(NewlineFraming)
+	c := &testClient{
+		t:    t,
+		conn: client,
+		in:   codec.MakeReader(client),
+		out:  codec.MakeWriter(client),
+	}
+	c.welcome = c.receive()
+	c.out <- &ArborMessage{Type: VERSION, Versions: SupportedVersions}
+	if reply := c.receive(); reply.Type != VERSION || reply.IsVersionRejection() {
+		t.Fatalf("Expected the server to agree on a version, got %s", reply)
+	}
+	return c
+}
+
+func (c *testClient) receive() *ArborMessage {
+	msg, ok := <-c.in
+	if !ok {
+		c.t.Fatal("Server closed the connection")
+	}
+	return msg
+}
+
+// request sends msg and returns the first message received after it.
+func (c *testClient) request(msg *ArborMessage) *ArborMessage {
+	c.out <- msg
+	return c.receive()
+}
+
+// peer sends a PEER request with token, and returns the reply.
+func (c *testClient) peer(token string) *ArborMessage {
+	return c.request(&ArborMessage{Type: PEER, RequestID: "peer", Token: token})
+}
+
+func TestPeersAreNotRateLimited(t *testing.T) {
+	server := newTestServer(t)
+	server.peerToken = "secret"
+	server.limits = NewRateLimiter(RateLimits{
+		Queries:      Rate{PerSecond: 0.001, Burst: 1},
+		SharedFactor: 1,
+	})
+	defer server.Shutdown(time.Second)
+	// queries returns the number of several queries that were refused
+	queries := func(c *testClient) int {
+		refused := 0
+		for i := 0; i < 5; i++ {
+			response := c.request(&ArborMessage{
+				Type:      QUERY,
+				RequestID: strconv.Itoa(i),
+				Message:   &Message{UUID: c.welcome.Root},
+			})
+			if response.Type == ERROR && response.Code == ERR_RATE_LIMITED {
+				refused++
+			} else if response.Type != NEW_MESSAGE {
+				t.Fatalf("Expected a response to the query, got %s", response)
+			}
+		}
+		return refused
+	}
+
+	peer := newTestClient(t, server)
+	defer peer.conn.Close()
+	if reply := peer.peer("secret"); reply.Type != PEER || reply.RequestID != "peer" {
+		t.Errorf("Expected the correct token to be accepted, got %s", reply)
+	}
+	if refused := queries(peer); refused != 0 {
+		t.Errorf("%d queries from a peer were rate limited", refused)
+	}
+
+	client := newTestClient(t, server)
+	defer client.conn.Close()
+	if reply := client.peer("guess"); reply.Type != ERROR || reply.Code != ERR_NOT_PERMITTED {
+		t.Errorf("Expected an incorrect token to be refused, got %s", reply)
+	}
+	if queries(client) == 0 {
+		t.Error("Queries from an ordinary client were not rate limited")
+	}
+}
+
+func TestViaIsOnlyTrustedFromPeers(t *testing.T) {
+	server := newTestServer(t)
+	server.peerToken = "secret"
+	server.validator.MaxAge = time.Hour
+	defer server.Shutdown(time.Second)
+	// post sends a message from two hours ago that claims to have been
+	// relayed, and returns the reply
+	post := func(c *testClient, content string) *ArborMessage {
+		return c.request(&ArborMessage{
+			Type: NEW_MESSAGE,
+			Via:  []string{"elsewhere"},
+			Message: &Message{
+				Parent:    c.welcome.Root,
+				Content:   content,
+				Username:  "tester",
+				Timestamp: time.Now().Add(-2 * time.Hour).Unix(),
+			},
+		})
+	}
+
+	client := newTestClient(t, server)
+	defer client.conn.Close()
+	if reply := post(client, "From a client"); reply.Type != ERROR || reply.Code != ERR_INVALID_TIMESTAMP {
+		t.Errorf("Expected an old message from a client to be refused, got %s", reply)
+	}
+
+	peer := newTestClient(t, server)
+	defer peer.conn.Close()
+	if reply := peer.peer("secret"); reply.Type != PEER {
+		t.Fatalf("Expected the correct token to be accepted, got %s", reply)
+	}
+	if reply := post(peer, "From a peer"); reply.Type != NEW_MESSAGE || len(reply.Via) != 1 {
+		t.Errorf("Expected an old message relayed by a peer to be accepted, got %s", reply)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Rate is the steady rate at which a kind of request is allowed, together with
+// the size of the burst permitted after a quiet period. A PerSecond of zero
+// allows any number of requests.
+type Rate struct {
+	PerSecond float64
+	Burst     int
+}
+
+// tokenBucket allows events at an average rate, holding up to a burst of
+// unused allowance.
+type tokenBucket struct {
+	rate   Rate
+	tokens float64
+	last   time.Time
+	sync.Mutex
+}
+
+func newTokenBucket(rate Rate, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		tokens: float64(rate.Burst),
+		last:   now,
+	}
+}
+
+// refill adds the allowance accumulated since the bucket was last used. The
+// caller must hold the lock.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate.PerSecond
+	if b.tokens > float64(b.rate.Burst) {
+		b.tokens = float64(b.rate.Burst)
+	}
+	b.last = now
+}
+
+// Allow takes a token from the bucket, and returns false if there was none to
+// take.
+func (b *tokenBucket) Allow(now time.Time) bool {
+	return allowAll(now, b)
+}
+
+// allowAll takes a token from each of buckets, and returns false, taking none,
+// if any of them has none to take. Buckets must always be passed in the same
+// order, so that their locks are taken in that order. A nil bucket places no
+// limit.
+func allowAll(now time.Time, buckets ...*tokenBucket) bool {
+	var limited []*tokenBucket
+	for _, b := range buckets {
+		if b != nil && b.rate.PerSecond != 0 {
+			limited = append(limited, b)
+		}
+	}
+	for _, b := range limited {
+		b.Lock()
+		defer b.Unlock()
+		b.refill(now)
+		if b.tokens < 1 {
+			return false
+		}
+	}
+	for _, b := range limited {
+		b.tokens--
+	}
+	return true
+}
+
+// full returns whether the bucket has regained its whole burst, in which case
+// discarding it and creating another later makes no difference.
+func (b *tokenBucket) full(now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+	b.refill(now)
+	return b.tokens >= float64(b.rate.Burst)
+}
+
+// bucketSweepInterval is how often a bucketSet discards buckets that have been
+// unused for long enough to refill.
+const bucketSweepInterval = time.Minute
+
+// bucketSet holds a token bucket for each key, such as a username or a remote
+// address, that shares a rate limit.
+type bucketSet struct {
+	rate      Rate
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	sync.Mutex
+}
+
+func newBucketSet(rate Rate) *bucketSet {
+	return &bucketSet{
+		rate:      rate,
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Get returns the bucket for key, or nil if the set places no limit.
+func (s *bucketSet) Get(key string, now time.Time) *tokenBucket {
+	if s.rate.PerSecond == 0 {
+		return nil
+	}
+	s.Lock()
+	if now.Sub(s.lastSweep) > bucketSweepInterval {
+		for k, b := range s.buckets {
+			if b.full(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.lastSweep = now
+	}
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = newTokenBucket(s.rate, now)
+		s.buckets[key] = bucket
+	}
+	s.Unlock()
+	return bucket
+}
+
+// RateLimits configures the limits placed on each client.
+type RateLimits struct {
+	// Posts and Queries limit the NEW_MESSAGEs and tree queries sent by each
+	// connection.
+	Posts   Rate
+	Queries Rate
+	// SharedFactor multiplies the per-connection rates to give the limits
+	// shared by every connection from the same remote address, and by every
+	// post with the same Username.
+	SharedFactor float64
+	// MaxInFlight is the number of requests from each connection that may be
+	// handled at once. Zero allows any number.
+	MaxInFlight int
+	// MaxThrottled is the number of throttled requests a connection may make
+	// each minute before it is disconnected. Zero never disconnects.
+	MaxThrottled int
+}
+
+// RateLimiter tracks the limits that are shared between connections.
+type RateLimiter struct {
+	limits           RateLimits
+	postsByAddress   *bucketSet
+	postsByName      *bucketSet
+	queriesByAddress *bucketSet
+}
+
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	return &RateLimiter{
+		limits:           limits,
+		postsByAddress:   newBucketSet(limits.Posts.scale(limits.SharedFactor)),
+		postsByName:      newBucketSet(limits.Posts.scale(limits.SharedFactor)),
+		queriesByAddress: newBucketSet(limits.Queries.scale(limits.SharedFactor)),
+	}
+}
+
+func (r Rate) scale(factor float64) Rate {
+	return Rate{
+		PerSecond: r.PerSecond * factor,
+		Burst:     int(float64(r.Burst) * factor),
+	}
+}
+
+// ClientLimiter applies rate limits to the requests of a single connection.
+type ClientLimiter struct {
+	shared  *RateLimiter
+	address string
+	posts   *tokenBucket
+	queries *tokenBucket
+	// throttled runs out when the client has been throttled too often
+	throttled *tokenBucket
+	// inFlight holds a token for each request being handled
+	inFlight chan struct{}
+}
+
+// ForClient creates a ClientLimiter for a connection from addr.
+func (r *RateLimiter) ForClient(addr net.Addr) *ClientLimiter {
+	now := time.Now()
+	address := addr.String()
+	if host, _, err := net.SplitHostPort(address); err == nil {
+		address = host
+	}
+	c := &ClientLimiter{
+		shared:  r,
+		address: address,
+		posts:   newTokenBucket(r.limits.Posts, now),
+		queries: newTokenBucket(r.limits.Queries, now),
+		throttled: newTokenBucket(Rate{
+			PerSecond: float64(r.limits.MaxThrottled) / 60,
+			Burst:     r.limits.MaxThrottled,
+		}, now),
+	}
+	if r.limits.MaxInFlight > 0 {
+		c.inFlight = make(chan struct{}, r.limits.MaxInFlight)
+	}
+	return c
+}
+
+// AllowPost returns whether the client may post a message as username.
+func (c *ClientLimiter) AllowPost(username string) bool {
+	now := time.Now()
+	return allowAll(now, c.posts, c.shared.postsByAddress.Get(c.address, now), c.shared.postsByName.Get(username, now))
+}
+
+// AllowQuery returns whether the client may query the message tree.
+func (c *ClientLimiter) AllowQuery() bool {
+	now := time.Now()
+	return allowAll(now, c.queries, c.shared.queriesByAddress.Get(c.address, now))
+}
+
+// Throttled records that one of the client's requests was refused, and
+// returns false if the client has been throttled so often that it should be
+// disconnected.
+func (c *ClientLimiter) Throttled() bool {
+	return c.throttled.Allow(time.Now())
+}
+
+// Begin reserves a slot for a request, and returns false if the client
+// already has as many requests in flight as it is allowed. Each successful
+// call must be followed by a call to End.
+func (c *ClientLimiter) Begin() bool {
+	if c.inFlight == nil {
+		return true
+	}
+	select {
+	case c.inFlight <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+// End releases the slot reserved by Begin.
+func (c *ClientLimiter) End() {
+	if c.inFlight != nil {
+		<-c.inFlight
+	}
+}
+
+// Go runs handler in a new goroutine, and releases the slot reserved by Begin
+// once it returns.
+func (c *ClientLimiter) Go(handler func()) {
+	go func() {
+		defer c.End()
+		handler()
+	}()
+}
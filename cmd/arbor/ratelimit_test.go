@@ -0,0 +1,30 @@
+package main
+
+import (
+	"net"
+	"testing"
+)
+
+func TestRefusedPostsSpendNoTokens(t *testing.T) {
+	limits := NewRateLimiter(RateLimits{
+		Posts:        Rate{PerSecond: 0.001, Burst: 1},
+		SharedFactor: 2,
+	})
+	client := func(host string) *ClientLimiter {
+		return limits.ForClient(&net.TCPAddr{IP: net.ParseIP(host), Port: 1234})
+	}
+
+	// two connections use up the allowance of the username between them
+	for _, host := range []string{"10.0.0.1", "10.0.0.2"} {
+		if !client(host).AllowPost("alice") {
+			t.Fatalf("Expected the first post from %s to be allowed", host)
+		}
+	}
+	third := client("10.0.0.3")
+	if third.AllowPost("alice") {
+		t.Fatal("Expected a third post as the same username to be refused")
+	}
+	if !third.AllowPost("bob") {
+		t.Error("A post refused for its username used up the allowance of the connection")
+	}
+}
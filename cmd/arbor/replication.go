@@ -0,0 +1,319 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
+)
+
+// handleReplicate sends a follower every message accepted after the one with
+// sequence number msg.Seq, and then each new message as it is accepted, until
+// the session ends. The follower names the last message that it has, so that
+// a follower whose journal differs from this server's is refused.
+func handleReplicate(msg *ArborMessage, client *Session, store Store, journal *Journal) {
+	if msg.Seq > 0 && (msg.Message == nil || journal.ID(msg.Seq) != msg.Message.UUID) {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ID, fmt.Sprintf("Message %d in the follower's journal is not message %d in this server's", msg.Seq, msg.Seq), ""))
+		return
+	}
+	log.Println("Replicating to", client, "after message", msg.Seq)
+	seq := msg.Seq
+	for {
+		ids, grew := journal.After(seq)
+		for _, id := range ids {
+			seq++
+			replicated := store.Get(id)
+			if replicated == nil {
+				log.Println("Unable to replicate message", id)
+				client.Send(errorResponse(msg, ERR_INTERNAL, "Unable to read message "+id, id))
+				return
+			}
+			if !client.Send(&ArborMessage{
+				Type:      REPLICATE,
+				RequestID: msg.RequestID,
+				Seq:       seq,
+				Message:   replicated,
+			}) {
+				return
+			}
+		}
+		if len(ids) > 0 {
+			continue
+		}
+		select {
+		case <-grew:
+		case <-client.Done():
+			return
+		}
+	}
+}
+
+// Follower keeps a read-only copy of another server, called its primary, by
+// replicating the primary's journal. The follower's clients may query the
+// copy and receive its new messages as they arrive, but may not post until
+// the follower is promoted to replace its primary.
+//
+// A follower's journal is always a prefix of its primary's, so the
+// sequence numbers of its messages are the same on both servers.
+type Follower struct {
+	address  string
+	config   *transport.ClientConfig
+	framing  Framing
+	rooms    *Rooms
+	store    Store
+	children *ChildIndex
+	journal  *Journal
+	// token is sent to the primary to identify this server as its peer
+	token string
+	// current is the connection to the primary, if there is one, and
+	// promoted is set once the follower has been promoted. Both are guarded
+	// by the lock.
+	current  *followerConn
+	promoted bool
+	sync.Mutex
+}
+
+func NewFollower(address string, config *transport.ClientConfig, framing Framing, token string, rooms *Rooms, store Store, children *ChildIndex, journal *Journal) *Follower {
+	return &Follower{
+		address:  address,
+		config:   config,
+		framing:  framing,
+		token:    token,
+		rooms:    rooms,
+		store:    store,
+		children: children,
+		journal:  journal,
+	}
+}
+
+// followerConn is a single connection to the primary server.
+type followerConn struct {
+	*peerConn
+	// ready is closed once the default room has been replicated
+	ready     chan struct{}
+	readyOnce sync.Once
+	// done is closed once the connection has stopped delivering messages
+	done chan struct{}
+}
+
+// Connect makes the first connection to the primary server, and waits until
+// the root of the default room has been replicated. It should be called after
+// the messages already in the store have been restored.
+func (f *Follower) Connect() error {
+	c, err := f.connect()
+	if err != nil {
+		return err
+	}
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+	select {
+	case <-c.ready:
+		return nil
+	case <-c.done:
+		return errors.Errorf("Lost connection to primary server %s", f.address)
+	case <-timeout.C:
+		c.conn.Close()
+		return errors.Errorf("Timed out waiting for the default room from primary server %s", f.address)
+	}
+}
+
+// Run replicates the primary server until the follower is promoted,
+// reconnecting whenever the connection is lost.
+func (f *Follower) Run() {
+	backoff := time.Second
+	for {
+		f.Lock()
+		c := f.current
+		f.Unlock()
+		if c != nil {
+			backoff = time.Second
+			<-c.done
+			c.conn.Close()
+			f.Lock()
+			f.current = nil
+			f.Unlock()
+			log.Println("Lost connection to primary server", f.address)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxUpstreamBackoff {
+			backoff = maxUpstreamBackoff
+		}
+		if !f.Following() {
+			return
+		}
+		if _, err := f.connect(); err != nil {
+			log.Println("Unable to reconnect to primary server:", err)
+		}
+	}
+}
+
+// Following returns whether the follower is still replicating its primary,
+// rather than having been promoted.
+func (f *Follower) Following() bool {
+	f.Lock()
+	defer f.Unlock()
+	return !f.promoted
+}
+
+// Promote stops replicating, so that the server accepts new messages itself.
+// Its journal carries on from the last message replicated. It returns once
+// no more replicated messages will be applied.
+func (f *Follower) Promote() {
+	f.Lock()
+	if f.promoted {
+		f.Unlock()
+		return
+	}
+	f.promoted = true
+	current := f.current
+	f.Unlock()
+	if current != nil {
+		current.conn.Close()
+		<-current.done
+	}
+	log.Println("Promoted to primary after replicating", f.journal.Last(), "messages")
+}
+
+// connect dials the primary server and asks it for every message after the
+// last one in the journal.
+func (f *Follower) connect() (*followerConn, error) {
+	peer, err := dialPeer(f.address, f.config, f.framing, f.token)
+	if err != nil {
+		return nil, err
+	}
+	c := &followerConn{
+		peerConn: peer,
+		ready:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	f.Lock()
+	defer f.Unlock()
+	if f.promoted {
+		c.conn.Close()
+		return nil, errors.New("Promoted while connecting to primary server")
+	}
+	f.current = c
+	if f.rooms.Default() != nil {
+		c.markReady()
+	}
+	go f.read(c)
+	last := f.journal.Last()
+	request := &ArborMessage{
+		Type: REPLICATE,
+		Seq:  last,
+	}
+	if last > 0 {
+		request.Message = &Message{UUID: f.journal.ID(last)}
+	}
+	c.requester.Send(request)
+	// new messages are delivered by replication instead
+	c.requester.Send(&ArborMessage{
+		Type: LEAVE,
+		Room: c.welcome.Room,
+	})
+	log.Println("Replicating primary server", f.address, "after message", last)
+	return c, nil
+}
+
+// read applies each message replicated from the primary server until the
+// connection is lost, or a message cannot be applied.
+func (f *Follower) read(c *followerConn) {
+	defer close(c.done)
+	defer c.requester.Close()
+	failed := false
+	for msg := range c.in {
+		if c.requester.Handle(msg) {
+			continue
+		}
+		switch msg.Type {
+		case REPLICATE:
+			if failed {
+				continue
+			}
+			if err := f.apply(msg); err != nil {
+				log.Println("Unable to replicate from primary server:", err)
+				failed = true
+				// the remaining messages are read until the connection
+				// closes, but not applied
+				c.conn.Close()
+				continue
+			}
+			if f.rooms.Default() != nil {
+				c.markReady()
+			}
+		case PING:
+			c.pong(msg)
+		case ERROR:
+			// the only request that can fail is the one to replicate
+			log.Println("Error from primary server:", msg.Reason)
+			c.conn.Close()
+		case SHUTDOWN:
+			log.Println("Primary server is shutting down:", msg.Reason)
+		}
+	}
+}
+
+// apply adds a replicated message to the local store and broadcasts it to
+// local clients. Messages must arrive in the order of their sequence numbers,
+// and those that have already been replicated are ignored.
+func (f *Follower) apply(replicated *ArborMessage) error {
+	msg := replicated.Message
+	if msg == nil {
+		return errors.New("Replicated message has no message fields")
+	}
+	if err := msg.VerifyID(); err != nil {
+		return err
+	}
+	// held from checking the sequence number until the message is recorded,
+	// so that a message accepted locally once the follower is promoted cannot
+	// take its number
+	f.journal.Lock()
+	defer f.journal.Unlock()
+	last := f.journal.last()
+	if replicated.Seq <= last {
+		return nil
+	}
+	if replicated.Seq != last+1 {
+		return errors.Errorf("Expected message %d, primary server sent message %d", last+1, replicated.Seq)
+	}
+	if msg.Parent != "" && f.store.Get(msg.Parent) == nil {
+		return errors.Errorf("Primary server sent message %s before its parent", msg.UUID)
+	}
+	if err := f.store.Add(msg); err != nil {
+		return errors.Wrap(err, "Unable to store replicated message")
+	}
+	f.journal.Record(msg.UUID)
+	if msg.Parent == "" {
+		name := roomName(msg)
+		if name == "" {
+			name = DefaultRoom
+		}
+		if f.rooms.Create(name, msg) != nil {
+			return nil
+		}
+	}
+	f.children.Add(msg)
+	room := f.rooms.Add(msg)
+	if room == nil {
+		return nil
+	}
+	room.Broadcaster.Send(&ArborMessage{
+		Type:    NEW_MESSAGE,
+		Room:    room.Name,
+		Seq:     replicated.Seq,
+		Prev:    room.Next(replicated.Seq),
+		Message: msg,
+	})
+	return nil
+}
+
+// markReady records that the default room has been replicated.
+func (c *followerConn) markReady() {
+	c.readyOnce.Do(func() {
+		close(c.ready)
+	})
+}
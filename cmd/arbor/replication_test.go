@@ -0,0 +1,36 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+func TestReplicationHoldsNoRequestSlot(t *testing.T) {
+	server := newTestServer(t)
+	server.limits = NewRateLimiter(RateLimits{
+		SharedFactor: 1,
+		MaxInFlight:  1,
+	})
+	defer server.Shutdown(time.Second)
+	follower := newTestClient(t, server)
+	defer follower.conn.Close()
+
+	replicated := follower.request(&ArborMessage{Type: REPLICATE, RequestID: "1"})
+	if replicated.Type != REPLICATE || replicated.Seq != 1 || replicated.Message.UUID != follower.welcome.Root {
+		t.Fatalf("Expected the root to be replicated, got %s", replicated)
+	}
+	reply := follower.request(&ArborMessage{
+		Type:      QUERY,
+		RequestID: "2",
+		Message:   &Message{UUID: follower.welcome.Root},
+	})
+	if reply.Type != NEW_MESSAGE {
+		t.Errorf("Expected a query to be answered while replicating, got %s", reply)
+	}
+	reply = follower.request(&ArborMessage{Type: REPLICATE, RequestID: "3"})
+	if reply.Type != ERROR || reply.Code != ERR_NOT_PERMITTED {
+		t.Errorf("Expected a second replication to be refused, got %s", reply)
+	}
+}
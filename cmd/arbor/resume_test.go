@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+func TestBroadcastsNameThePreviousMessage(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown(time.Second)
+	client := newTestClient(t, server)
+	defer client.conn.Close()
+	// post returns the broadcast of a new reply to the root
+	post := func(content string) *ArborMessage {
+		reply := client.request(&ArborMessage{
+			Type: NEW_MESSAGE,
+			Message: &Message{
+				Parent:    client.welcome.Root,
+				Content:   content,
+				Username:  "tester",
+				Timestamp: time.Now().Unix(),
+			},
+		})
+		if reply.Type != NEW_MESSAGE || reply.Seq == 0 {
+			t.Fatalf("Expected a numbered broadcast of the new message, got %s", reply)
+		}
+		return reply
+	}
+
+	first := post("First")
+	if first.Prev >= first.Seq {
+		t.Errorf("Expected the first message to follow an older one, got %s", first)
+	}
+	if second := post("Second"); second.Prev != first.Seq {
+		t.Errorf("Expected the second message to follow message %d, got %s", first.Seq, second)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"sync"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// DefaultRoom is the name of the room that clients are placed in when they
+// connect. Its root is the server's original root message, which predates
+// rooms and so does not carry a room name.
+const DefaultRoom = "default"
+
+// Room is an independent conversation tree with its own root message, recent
+// messages, and set of clients that receive its new messages.
+type Room struct {
+	Name        string
+	RootID      string
+	Recents     *RecentList
+	Broadcaster *Broadcaster
+	// last is the sequence number of the room's newest message
+	last uint64
+}
+
+// Next records that the message with sequence number seq is the newest in
+// the room, and returns the sequence number of the one before it, or zero if
+// there is none. The caller must hold the journal lock.
+func (r *Room) Next(seq uint64) uint64 {
+	prev := r.last
+	r.last = seq
+	return prev
+}
+
+// Rooms holds every room on the server, and records the room to which each
+// message belongs.
+type Rooms struct {
+	byName   map[string]*Room
+	names    []string
+	messages map[string]*Room
+	// queueSize and policy configure the Broadcaster of each new room
+	queueSize int
+	policy    SlowClientPolicy
+	sync.RWMutex
+}
+
+func NewRooms(queueSize int, policy SlowClientPolicy) *Rooms {
+	return &Rooms{
+		byName:    make(map[string]*Room),
+		messages:  make(map[string]*Room),
+		queueSize: queueSize,
+		policy:    policy,
+	}
+}
+
+// Create adds a room whose root message is root. It returns nil if there is
+// already a room with the same name.
+func (r *Rooms) Create(name string, root *Message) *Room {
+	r.Lock()
+	defer r.Unlock()
+	if _, exists := r.byName[name]; exists {
+		return nil
+	}
+	room := &Room{
+		Name:        name,
+		RootID:      root.UUID,
+		Recents:     NewRecents(10),
+		Broadcaster: NewBroadcaster(r.queueSize, r.policy),
+	}
+	r.byName[name] = room
+	r.names = append(r.names, name)
+	r.messages[root.UUID] = room
+	return room
+}
+
+// Get returns the room with the given name, or nil if there is none.
+func (r *Rooms) Get(name string) *Room {
+	r.RLock()
+	defer r.RUnlock()
+	return r.byName[name]
+}
+
+// Default returns the room that new clients join.
+func (r *Rooms) Default() *Room {
+	return r.Get(DefaultRoom)
+}
+
+// Names returns the name of every room, in the order they were created.
+func (r *Rooms) Names() []string {
+	r.RLock()
+	defer r.RUnlock()
+	names := make([]string, len(r.names))
+	copy(names, r.names)
+	return names
+}
+
+// Of returns the room containing the message with the given id, or nil if
+// the message is not known.
+func (r *Rooms) Of(id string) *Room {
+	r.RLock()
+	defer r.RUnlock()
+	return r.messages[id]
+}
+
+// Add records msg as a recent message in the room of its parent, and returns
+// that room. Messages whose parent is unknown are placed in the default
+// room, and nil is returned if there is no default room, as on an edge server
+// that has not yet reached its upstream server.
+func (r *Rooms) Add(msg *Message) *Room {
+	r.Lock()
+	room, ok := r.messages[msg.Parent]
+	if !ok {
+		room = r.byName[DefaultRoom]
+	}
+	if room == nil {
+		r.Unlock()
+		return nil
+	}
+	r.messages[msg.UUID] = room
+	r.Unlock()
+	room.Recents.Add(msg.UUID)
+	return room
+}
+
+// roomName returns the name of the room that root was created for, or ""
+// if it is not a room's root message.
+func roomName(root *Message) string {
+	var name string
+	if ok, err := root.GetMeta(RoomKey, &name); !ok || err != nil {
+		return ""
+	}
+	return name
+}
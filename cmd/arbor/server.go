@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// Server holds the state shared by every client connection, however the
+// client is connected.
+type Server struct {
+	rooms    *Rooms
+	store    Store
+	children *ChildIndex
+	// journal records the order in which messages were accepted
+	journal *Journal
+	// validator checks each new message before it is accepted
+	validator *Validator
+	// limits restricts how quickly each client may make requests
+	limits *RateLimiter
+	// keepalive decides when quiet clients are pinged and disconnected
+	keepalive Keepalive
+	// peerToken is the secret that identifies other servers as peers, to
+	// which the rate limits do not apply. No client is a peer if it is empty.
+	peerToken string
+	// ctx is cancelled to close every remaining session immediately, while
+	// closing draining asks each of them to finish sending what it has queued
+	ctx      context.Context
+	cancel   context.CancelFunc
+	draining chan struct{}
+	clients  sync.WaitGroup
+	// shuttingDown is set once draining is closed, after which no new
+	// clients are accepted. The lock also guards additions to clients.
+	shuttingDown bool
+	sync.Mutex
+}
+
+func NewServer(rooms *Rooms, store Store, children *ChildIndex, journal *Journal, validator *Validator, limits *RateLimiter, keepalive Keepalive, peerToken string) *Server {
+	s := &Server{
+		rooms:     rooms,
+		store:     store,
+		children:  children,
+		journal:   journal,
+		validator: validator,
+		limits:    limits,
+		keepalive: keepalive,
+		peerToken: peerToken,
+		draining:  make(chan struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	return s
+}
+
+// Serve begins a session with the client on conn, which uses the provided
+// framing. It returns without waiting for the session to end.
+func (s *Server) Serve(conn net.Conn, framing Framing) {
+	s.Lock()
+	if s.shuttingDown {
+		s.Unlock()
+		conn.Close()
+		return
+	}
+	s.clients.Add(1)
+	s.Unlock()
+	session := NewSession(s.ctx, conn, framing, s.keepalive.writeTimeout())
+	go func() {
+		defer s.clients.Done()
+		handleClient(session, s.rooms, s.store, s.children, s.journal, s.validator, s.limits, s.keepalive, s.peerToken)
+	}()
+	go func() {
+		select {
+		case <-s.draining:
+			session.Shutdown(&ArborMessage{
+				Type:   SHUTDOWN,
+				Reason: "Server is shutting down",
+			})
+		case <-session.Done():
+		}
+	}()
+}
+
+// Shutdown stops accepting new clients and tells each connected client that
+// the server is shutting down once its queued messages have been sent. It
+// returns when every client has disconnected, or after timeout, in which
+// case the remaining clients are disconnected immediately.
+func (s *Server) Shutdown(timeout time.Duration) {
+	s.Lock()
+	if !s.shuttingDown {
+		s.shuttingDown = true
+		close(s.draining)
+	}
+	s.Unlock()
+	finished := make(chan struct{})
+	go func() {
+		s.clients.Wait()
+		close(finished)
+	}()
+	deadline := time.NewTimer(timeout)
+	select {
+	case <-finished:
+		deadline.Stop()
+	case <-deadline.C:
+		log.Println("Shutdown deadline passed, disconnecting remaining clients")
+	}
+	s.cancel()
+}
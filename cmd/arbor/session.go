@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// flushTimeout is how long a session waits for the messages it has already
+// accepted to be written when it finishes.
+const flushTimeout = 5 * time.Second
+
+// writeTimeout is how long the client may take to accept each message before
+// its connection is considered to have failed.
+const writeTimeout = 30 * time.Second
+
+// Session owns everything associated with a single client connection: the
+// connection itself, the goroutines reading from and writing to it, and its
+// registrations with Broadcasters. Closing the session, or the failure of
+// any one of those parts, tears all of them down.
+type Session struct {
+	conn      net.Conn
+	codec     *Codec
+	from      <-chan *ArborMessage
+	to        chan<- *ArborMessage
+	ctx       context.Context
+	cancel    context.CancelFunc
+	closeOnce sync.Once
+	// written is closed once everything sent on to has been written
+	written <-chan struct{}
+	// closed is set (while holding the write lock) once to has been closed.
+	// Send holds the read lock so that it never sends on a closed channel.
+	closed bool
+	sync.RWMutex
+	// broadcasters holds every Broadcaster that the session has joined. It
+	// is set to nil once the session is closed.
+	broadcasters     map[*Broadcaster]struct{}
+	broadcastersLock sync.Mutex
+}
+
+// NewSession starts reading and writing messages on conn. Writing a message
+// fails if it takes longer than timeout, which closes the connection. The
+// session is closed when ctx is cancelled.
+func NewSession(ctx context.Context, conn net.Conn, framing Framing, timeout time.Duration) *Session {
+	s := &Session{
+		conn:         conn,
+		codec:        NewCodec(framing),
+		broadcasters: make(map[*Broadcaster]struct{}),
+	}
+	s.ctx, s.cancel = context.WithCancel(ctx)
+	s.to, s.written = s.codec.MakeWriterWithDone(&timedWriter{Conn: conn, timeout: timeout})
+	s.codec.OnReadError = func(e *ArborMessage) {
+		s.Send(e)
+	}
+	s.from = s.codec.MakeReader(conn)
+	go func() {
+		<-s.ctx.Done()
+		s.Close()
+	}()
+	return s
+}
+
+// Messages returns the messages received from the client. The channel is
+// closed once the connection has ended.
+func (s *Session) Messages() <-chan *ArborMessage {
+	return s.from
+}
+
+// Done returns a channel that is closed when the session is closed.
+func (s *Session) Done() <-chan struct{} {
+	return s.ctx.Done()
+}
+
+// Join begins delivering the messages sent by broadcaster to the client.
+// Joining the same Broadcaster more than once has no effect.
+func (s *Session) Join(broadcaster *Broadcaster) {
+	s.broadcastersLock.Lock()
+	defer s.broadcastersLock.Unlock()
+	if s.broadcasters == nil {
+		return
+	}
+	if _, joined := s.broadcasters[broadcaster]; !joined {
+		s.broadcasters[broadcaster] = struct{}{}
+		broadcaster.Add(s)
+	}
+}
+
+// Leave stops delivering the messages sent by broadcaster to the client.
+func (s *Session) Leave(broadcaster *Broadcaster) {
+	s.broadcastersLock.Lock()
+	defer s.broadcastersLock.Unlock()
+	if _, joined := s.broadcasters[broadcaster]; joined {
+		delete(s.broadcasters, broadcaster)
+		broadcaster.Remove(s)
+	}
+}
+
+// leaveAll leaves every Broadcaster and prevents any more from being joined.
+// If drain is set, it waits for the messages queued by each of them to be
+// delivered.
+func (s *Session) leaveAll(drain bool) {
+	s.broadcastersLock.Lock()
+	defer s.broadcastersLock.Unlock()
+	for broadcaster := range s.broadcasters {
+		if drain {
+			broadcaster.Drain(s)
+		} else {
+			broadcaster.Remove(s)
+		}
+	}
+	s.broadcasters = nil
+}
+
+// Send queues msg to be written to the client. It returns false without
+// sending if the session has been closed. It waits while an earlier message
+// is being written, which can take no longer than the session's write
+// timeout.
+func (s *Session) Send(msg *ArborMessage) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.to <- msg:
+		return true
+	case <-s.ctx.Done():
+		return false
+	}
+}
+
+// TrySend is like Send, but it gives up at once, returning false, if msg cannot
+// be queued immediately.
+func (s *Session) TrySend(msg *ArborMessage) bool {
+	s.RLock()
+	defer s.RUnlock()
+	if s.closed {
+		return false
+	}
+	select {
+	case s.to <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetReadDeadline makes reading from the client fail, ending the session, if
+// nothing arrives before t.
+func (s *Session) SetReadDeadline(t time.Time) {
+	s.conn.SetReadDeadline(t)
+}
+
+// Close ends the session. It is safe to call more than once and from any
+// goroutine.
+func (s *Session) Close() {
+	s.closeOnce.Do(func() {
+		// cancelling first releases any Send blocked on the writer
+		s.cancel()
+		s.conn.Close()
+		s.closeWriter()
+		// the reader may be waiting to hand over one last message before it
+		// notices that the connection is closed
+		go func() {
+			for range s.from {
+			}
+		}()
+		s.leaveAll(false)
+	})
+}
+
+// Finish stops sending messages to the client, and closes the session once
+// those that have already been sent are written, or after flushTimeout.
+func (s *Session) Finish() {
+	timer := time.NewTimer(flushTimeout)
+	defer timer.Stop()
+	s.closeWhenWritten(timer.C)
+}
+
+// Shutdown delivers every broadcast message already queued for the client,
+// followed by notice, and then closes the session once all of them have been
+// written to the connection. If the session's context is cancelled before
+// then, the session is closed immediately.
+func (s *Session) Shutdown(notice *ArborMessage) {
+	s.leaveAll(true)
+	s.Send(notice)
+	s.closeWhenWritten(nil)
+}
+
+// closeWhenWritten closes the writer, then closes the session once every
+// message has been written, the session's context is cancelled, or timeout
+// fires (a nil timeout never fires).
+func (s *Session) closeWhenWritten(timeout <-chan time.Time) {
+	// closing the writer waits for any Send in progress, which may be waiting
+	// for the connection, so the timeout must apply to that too
+	go s.closeWriter()
+	select {
+	case <-s.written:
+	case <-s.ctx.Done():
+	case <-timeout:
+	}
+	s.Close()
+}
+
+// closeWriter stops any further messages from being sent to the client.
+func (s *Session) closeWriter() {
+	s.Lock()
+	defer s.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.to)
+	}
+}
+
+// Version returns the protocol version in use on the connection.
+func (s *Session) Version() Version {
+	return s.codec.Version()
+}
+
+// RemoteAddr returns the address of the client.
+func (s *Session) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
+func (s *Session) String() string {
+	return s.conn.RemoteAddr().String()
+}
+
+// timedWriter sets a deadline for each write to its connection, so that a
+// client that stops reading cannot hold up its session forever.
+type timedWriter struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (w *timedWriter) Write(p []byte) (int, error) {
+	if w.timeout > 0 {
+		w.SetWriteDeadline(time.Now().Add(w.timeout))
+	}
+	return w.Conn.Write(p)
+}
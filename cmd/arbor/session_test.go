@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// newTestServer creates a server holding only the default room, without rate
+// limits or keepalives.
+func newTestServer(t *testing.T) *Server {
+	store := NewStore()
+	journal := NewJournal()
+	rooms := NewRooms(4, DropOldest)
+	if err := createRooms(store, journal, rooms, []string{DefaultRoom}); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(rooms, store, NewChildIndex(), journal, NewValidator(store), NewRateLimiter(RateLimits{}), Keepalive{}, "")
+}
+
+// settledGoroutines waits briefly for the number of goroutines to fall to at
+// most limit, and returns the number remaining.
+func settledGoroutines(limit int) int {
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= limit || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// drained waits briefly for every session to leave broadcaster, and returns
+// the number remaining.
+func drained(broadcaster *Broadcaster) int {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := broadcaster.Len()
+		if n == 0 || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSessionsLeaveNothingBehind(t *testing.T) {
+	const sessions, batchSize = 3000, 300
+	server := newTestServer(t)
+	server.keepalive = Keepalive{Interval: 50 * time.Millisecond, Timeout: 200 * time.Millisecond}
+	defer server.Shutdown(0)
+	address := listen(t, server)
+	broadcaster := server.rooms.Default().Broadcaster
+	base := runtime.NumGoroutine()
+	var err error
+	for batch := 0; batch < sessions/batchSize; batch++ {
+		// quiet clients stay connected until the server disconnects them,
+		// and are closed once each batch has finished
+		var quiet []net.Conn
+		for i := 0; i < batchSize; i++ {
+			var conn net.Conn
+			if i%6 == 5 {
+				// unlike a socket, a pipe has no buffer, so writing to a
+				// quiet client on one blocks
+				var serverConn net.Conn
+				serverConn, conn = net.Pipe()
+				server.Serve(serverConn, NewlineFraming)
+			} else if conn, err = net.Dial("tcp", address); err != nil {
+				t.Fatal(err)
+			}
+			conn.SetDeadline(time.Now().Add(5 * time.Second))
+			switch i % 3 {
+			case 0:
+				// reads its welcome, then disconnects
+				if _, ok := <-NewCodec(NewlineFraming).MakeReader(conn); !ok {
+					t.Fatal("Session closed before welcoming the client")
+				}
+				conn.Close()
+			case 1:
+				// sends a message without reading anything, then disconnects
+				fmt.Fprintf(conn, `{"Type":%d,"Message":{"UUID":"nope"}}`+"\n", QUERY)
+				conn.Close()
+			case 2:
+				// stays connected, but neither reads nor answers PINGs
+				fmt.Fprintf(conn, `{"Type":%d,"Versions":[{"Major":0,"Minor":2}]}`+"\n", VERSION)
+				quiet = append(quiet, conn)
+			}
+		}
+		if n := drained(broadcaster); n != 0 {
+			t.Fatalf("%d sessions of batch %d are still registered with the broadcaster", n, batch)
+		}
+		for _, conn := range quiet {
+			conn.Close()
+		}
+	}
+	if n := settledGoroutines(base); n > base {
+		buf := make([]byte, 1<<16)
+		t.Errorf("%d goroutines remain from %d finished sessions\n%s", n-base, sessions, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+func TestOversizedMessagesAreRefused(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown(time.Second)
+	client := newTestClient(t, server)
+	defer client.conn.Close()
+
+	// the server stops reading partway through, so the write only ends once
+	// the connection is closed
+	line := `{"Type":2,"Message":{"Content":"` + strings.Repeat("a", MaxMessageSize) + `"}}` + "\n"
+	go client.conn.Write([]byte(line))
+	if reply := client.receive(); reply.Type != ERROR || reply.Code != ERR_TOO_LARGE {
+		t.Errorf("Expected an oversized message to be refused, got %s", reply)
+	}
+}
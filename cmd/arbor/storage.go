@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// openStore creates the server's message store. If path is empty, messages
+// are only held in memory. Otherwise, they are saved in the file at path.
+func openStore(path string) (Store, error) {
+	if path == "" {
+		return NewStore(), nil
+	}
+	return OpenLogStore(path)
+}
+
+// closeStore saves and closes store if it is persistent.
+func closeStore(store Store) error {
+	if persistent, ok := store.(PersistentStore); ok {
+		return persistent.Close()
+	}
+	return nil
+}
+
+// restoreTree rebuilds the server's indices and rooms from the messages
+// already in the store, recording them in the journal in the order that they
+// were added. A message without a parent is the root of the room named in its
+// metadata, and the first such message that does not name a room is the root
+// of the default room. The most recently added messages of each room are used
+// to fill its recents.
+func restoreTree(store Store, children *ChildIndex, journal *Journal, rooms *Rooms) error {
+	persistent, ok := store.(PersistentStore)
+	if !ok {
+		return nil
+	}
+	count := 0
+	journal.Lock()
+	defer journal.Unlock()
+	err := persistent.Each(func(msg *Message) {
+		count++
+		seq := journal.Record(msg.UUID)
+		if rooms.Of(msg.UUID) != nil {
+			// already adopted from an upstream server
+			return
+		}
+		if msg.Parent == "" {
+			name := roomName(msg)
+			if name == "" {
+				name = DefaultRoom
+			}
+			if rooms.Create(name, msg) != nil {
+				return
+			}
+		}
+		children.Add(msg)
+		if room := rooms.Add(msg); room != nil {
+			room.Next(seq)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	log.Println("Loaded", count, "messages from storage")
+	return nil
+}
+
+// createRooms creates a root message for each of roomNames if there is not
+// already a room with that name.
+func createRooms(store Store, journal *Journal, rooms *Rooms, roomNames []string) error {
+	journal.Lock()
+	defer journal.Unlock()
+	for _, name := range roomNames {
+		if rooms.Get(name) != nil {
+			continue
+		}
+		root, err := newRoomRoot(name)
+		if err != nil {
+			return err
+		}
+		if err := store.Add(root); err != nil {
+			return err
+		}
+		journal.Record(root.UUID)
+		rooms.Create(name, root)
+	}
+	return nil
+}
+
+// newRoomRoot creates the root message of a new room. The default room's
+// root does not name the room, just like the root messages saved before
+// there were rooms.
+func newRoomRoot(name string) (*Message, error) {
+	content := name
+	if name == DefaultRoom {
+		content = "Root message"
+	}
+	root, err := NewMessage(content)
+	if err != nil {
+		return nil, err
+	}
+	if name != DefaultRoom {
+		if err := root.SetMeta(RoomKey, name); err != nil {
+			return nil, err
+		}
+	}
+	root.AssignHashID()
+	return root, nil
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// syncChunkSize is the number of reply digests sent in each SYNC response,
+// which keeps the responses well below MaxMessageSize.
+const syncChunkSize = 256
+
+// requestTimeout bounds how long a peer server may take to answer a request.
+const requestTimeout = 30 * time.Second
+
+// handleSync sends the digest of the queried message's subtree, followed by
+// the digests of the subtrees beneath each of its replies.
+func handleSync(msg *ArborMessage, client *Session, store Store, children *ChildIndex) {
+	if store.Get(msg.Message.UUID) == nil {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ID, "No message with id "+msg.Message.UUID, msg.Message.UUID))
+		return
+	}
+	summary := children.Summarize(msg.Message.UUID)
+	chunk := make(map[string]string)
+	for id, digest := range summary.Children {
+		chunk[id] = digest
+		if len(chunk) == syncChunkSize {
+			sendSyncChunk(msg, summary.Digest, chunk, client)
+			chunk = make(map[string]string)
+		}
+	}
+	if len(chunk) > 0 || len(summary.Children) == 0 {
+		sendSyncChunk(msg, summary.Digest, chunk, client)
+	}
+	finish(msg, client)
+}
+
+func sendSyncChunk(msg *ArborMessage, digest string, chunk map[string]string, client *Session) {
+	client.Send(&ArborMessage{
+		Type:      SYNC,
+		RequestID: msg.RequestID,
+		Digest:    digest,
+		Digests:   chunk,
+		Message:   &Message{UUID: msg.Message.UUID},
+	})
+}
+
+// treeSync reconciles a subtree of the local message tree with the same
+// subtree on a peer server. It compares the digests of the two subtrees and
+// only descends into the parts that differ, so the number of requests it
+// makes depends on how much the trees differ rather than on their size.
+type treeSync struct {
+	peer     *Requester
+	store    Store
+	children *ChildIndex
+	// accept adds a message pulled from the peer, whose parent is already
+	// present, and returns false if it was not added
+	accept func(*Message) bool
+	// push, if set, sends a message that the peer is missing to it. Messages
+	// are pushed parent first.
+	push func(*Message)
+	// pulled and pushed count the messages transferred
+	pulled, pushed int
+}
+
+// run reconciles the subtree beneath the message with the given id, which
+// both servers must have.
+func (t *treeSync) run(id string) error {
+	var digest string
+	remote := make(map[string]string)
+	err := await(t.peer, &ArborMessage{
+		Type:    SYNC,
+		Message: &Message{UUID: id},
+	}, DONE, func(response *ArborMessage) {
+		digest = response.Digest
+		for child, childDigest := range response.Digests {
+			remote[child] = childDigest
+		}
+	})
+	if err != nil {
+		return err
+	}
+	local := t.children.Summarize(id)
+	if digest == local.Digest {
+		return nil
+	}
+	for child, childDigest := range remote {
+		if localDigest, ok := local.Children[child]; !ok {
+			if err := t.pull(child); err != nil {
+				return err
+			}
+		} else if localDigest != childDigest {
+			if err := t.run(child); err != nil {
+				return err
+			}
+		}
+	}
+	if t.push != nil {
+		for child := range local.Children {
+			if _, ok := remote[child]; !ok {
+				t.pushSubtree(child)
+			}
+		}
+	}
+	return nil
+}
+
+// pull adds the peer's subtree beneath the message with the given id, which
+// is missing locally.
+func (t *treeSync) pull(id string) error {
+	var batch []*Message
+	err := await(t.peer, &ArborMessage{
+		Type:    SUBTREE,
+		Limit:   maxTreeQueryResults,
+		Message: &Message{UUID: id},
+	}, DONE, func(response *ArborMessage) {
+		if response.Type == NEW_MESSAGE && response.Message != nil {
+			batch = append(batch, response.Message)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	// the subtree is sent parent first
+	for _, msg := range batch {
+		if t.accept(msg) {
+			t.pulled++
+		}
+	}
+	if t.store.Get(id) == nil {
+		return errors.Errorf("Unable to add message %s from peer", id)
+	}
+	if len(batch) >= maxTreeQueryResults {
+		// the peer stopped early, so look for what is still missing
+		return t.run(id)
+	}
+	return nil
+}
+
+// pushSubtree pushes the local subtree beneath the message with the given id,
+// which the peer is missing.
+func (t *treeSync) pushSubtree(id string) {
+	level := []string{id}
+	for len(level) > 0 {
+		next := []string{}
+		for _, id := range level {
+			msg := t.store.Get(id)
+			if msg == nil {
+				log.Println("Unable to push missing message", id)
+				continue
+			}
+			t.push(msg)
+			t.pushed++
+			next = append(next, t.children.Children(id)...)
+		}
+		level = next
+	}
+}
+
+// request sends msg to a peer server and returns its response, which must be
+// of type final.
+func request(peer *Requester, msg *ArborMessage, final ArborMessageType) (*ArborMessage, error) {
+	var reply *ArborMessage
+	err := await(peer, msg, final, func(response *ArborMessage) {
+		reply = response
+	})
+	if err != nil {
+		return nil, err
+	}
+	return reply, nil
+}
+
+// await sends msg to a peer server and calls handle with each response until
+// one of type final arrives. An ERROR response is returned as an error.
+func await(peer *Requester, msg *ArborMessage, final ArborMessageType, handle func(*ArborMessage)) error {
+	responses := peer.Request(msg)
+	timeout := time.NewTimer(requestTimeout)
+	defer timeout.Stop()
+	for {
+		select {
+		case response, ok := <-responses:
+			if !ok {
+				return errors.New("Connection to peer server closed")
+			}
+			if response.Type == ERROR {
+				return errors.Errorf("Peer server refused request: %s", response.Reason)
+			}
+			handle(response)
+			if response.Type == final {
+				return nil
+			}
+		case <-timeout.C:
+			peer.Cancel(msg.RequestID)
+			return errors.New("Timed out waiting for peer server")
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// newEdgeTestServer creates a server whose default room has the same root as
+// that of upstream, but none of its other messages.
+func newEdgeTestServer(t *testing.T, upstream *Server) *Server {
+	store := NewStore()
+	journal := NewJournal()
+	rooms := NewRooms(4, DropOldest)
+	root := *upstream.store.Get(upstream.rooms.Default().RootID)
+	if err := store.Add(&root); err != nil {
+		t.Fatal(err)
+	}
+	journal.Record(root.UUID)
+	rooms.Create(DefaultRoom, &root)
+	return NewServer(rooms, store, NewChildIndex(), journal, NewValidator(store), NewRateLimiter(RateLimits{}), Keepalive{}, "")
+}
+
+// post sends a new message and returns its ID.
+func (c *testClient) post(parent, content string, timestamp int64) string {
+	reply := c.request(&ArborMessage{
+		Type: NEW_MESSAGE,
+		Message: &Message{
+			Parent:    parent,
+			Content:   content,
+			Username:  "tester",
+			Timestamp: timestamp,
+		},
+	})
+	if reply.Type != NEW_MESSAGE {
+		c.t.Fatalf("Expected the new message to be accepted, got %s", reply)
+	}
+	return reply.Message.UUID
+}
+
+func TestSyncReconcilesTrees(t *testing.T) {
+	upstream := newTestServer(t)
+	upstream.peerToken = "secret"
+	defer upstream.Shutdown(time.Second)
+	edge := newEdgeTestServer(t, upstream)
+	defer edge.Shutdown(time.Second)
+	root := upstream.rooms.Default().RootID
+	now := time.Now().Unix()
+
+	// the servers share part of their trees, but each has branches and
+	// leaves that the other lacks
+	up := newTestClient(t, upstream)
+	defer up.conn.Close()
+	down := newTestClient(t, edge)
+	defer down.conn.Close()
+	shared := up.post(root, "Shared", now)
+	if id := down.post(root, "Shared", now); id != shared {
+		t.Fatalf("Identical messages were given different IDs %s and %s", shared, id)
+	}
+	var ids []string
+	for _, c := range []*testClient{up, down} {
+		branch := c.post(root, "Branch", now+int64(len(ids)))
+		leaf := c.post(branch, "Leaf", now)
+		reply := c.post(shared, "Reply", now+int64(len(ids)))
+		nested := c.post(reply, "Nested", now)
+		ids = append(ids, branch, leaf, reply, nested)
+	}
+
+	conn, client := net.Pipe()
+	upstream.Serve(conn, NewlineFraming)
+	peer, err := newPeerConn(client, "upstream", NewlineFraming, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	mirror := NewUpstream("upstream", nil, NewlineFraming, "edge", "secret", edge.rooms, edge.store, edge.children, edge.journal)
+	c := &upstreamConn{
+		peerConn: peer,
+		done:     make(chan struct{}),
+	}
+	go mirror.read(c)
+	if err := mirror.join(c); err != nil {
+		t.Fatal(err)
+	}
+	go mirror.serve(c)
+
+	deadline := time.Now().Add(5 * time.Second)
+	for upstream.children.Summarize(root).Digest != edge.children.Summarize(root).Digest {
+		if time.Now().After(deadline) {
+			t.Fatal("Digests of the trees still differ after synchronizing")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, id := range ids {
+		if upstream.store.Get(id) == nil || edge.store.Get(id) == nil {
+			t.Errorf("Message %s is missing from one of the servers", id)
+		}
+	}
+}
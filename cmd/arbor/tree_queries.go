@@ -0,0 +1,133 @@
+package main
+
+import (
+	"log"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// maxTreeQueryResults is the largest number of messages that will be sent
+// in response to a single tree query, regardless of its Limit.
+const maxTreeQueryResults = 4096
+
+// treeQueryLimit returns the number of results permitted for the query msg.
+func treeQueryLimit(msg *ArborMessage) int {
+	if msg.Limit == 0 || msg.Limit > maxTreeQueryResults {
+		return maxTreeQueryResults
+	}
+	return int(msg.Limit)
+}
+
+// respond sends result as one of the responses to the request msg.
+func respond(msg *ArborMessage, result *Message, client *Session) {
+	client.Send(&ArborMessage{
+		Type:      NEW_MESSAGE,
+		RequestID: msg.RequestID,
+		Message:   result,
+	})
+}
+
+// finish tells the client that every response to msg has been sent.
+func finish(msg *ArborMessage, client *Session) {
+	client.Send(&ArborMessage{
+		Type:      DONE,
+		RequestID: msg.RequestID,
+		Message:   &Message{UUID: msg.Message.UUID},
+	})
+}
+
+// ancestry returns the message with the given id followed by up to limit of
+// its ancestors, nearest first. It returns nil if there is no such message.
+func ancestry(store Store, id string, limit int) []*Message {
+	current := store.Get(id)
+	if current == nil {
+		return nil
+	}
+	result := []*Message{current}
+	for remaining := limit; remaining > 0 && current.Parent != ""; remaining-- {
+		parent := store.Get(current.Parent)
+		if parent == nil {
+			log.Println("Ancestry of", id, "is missing", current.Parent)
+			break
+		}
+		current = parent
+		result = append(result, current)
+	}
+	return result
+}
+
+// childMessages returns up to maxTreeQueryResults direct replies to the
+// message with the given id, and whether that message exists.
+func childMessages(store Store, children *ChildIndex, id string) ([]*Message, bool) {
+	if store.Get(id) == nil {
+		return nil, false
+	}
+	result := []*Message{}
+	for _, childID := range children.Children(id) {
+		if len(result) >= maxTreeQueryResults {
+			break
+		}
+		if child := store.Get(childID); child != nil {
+			result = append(result, child)
+		}
+	}
+	return result, true
+}
+
+// handleAncestry sends the queried message followed by up to Limit of its
+// ancestors, nearest first.
+func handleAncestry(msg *ArborMessage, client *Session, store Store) {
+	results := ancestry(store, msg.Message.UUID, treeQueryLimit(msg))
+	if results == nil {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ID, "No message with id "+msg.Message.UUID, msg.Message.UUID))
+		return
+	}
+	for _, result := range results {
+		respond(msg, result, client)
+	}
+	finish(msg, client)
+}
+
+// handleChildren sends every direct reply to the queried message.
+func handleChildren(msg *ArborMessage, client *Session, store Store, children *ChildIndex) {
+	results, ok := childMessages(store, children, msg.Message.UUID)
+	if !ok {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ID, "No message with id "+msg.Message.UUID, msg.Message.UUID))
+		return
+	}
+	for _, result := range results {
+		respond(msg, result, client)
+	}
+	finish(msg, client)
+}
+
+// handleSubtree sends the queried message and all of its descendants that
+// are no more than Limit levels below it, in breadth-first order.
+func handleSubtree(msg *ArborMessage, client *Session, store Store, children *ChildIndex) {
+	root := store.Get(msg.Message.UUID)
+	if root == nil {
+		client.Send(errorResponse(msg, ERR_UNKNOWN_ID, "No message with id "+msg.Message.UUID, msg.Message.UUID))
+		return
+	}
+	respond(msg, root, client)
+	sent := 1
+	level := []string{root.UUID}
+	for depth := 0; depth < int(msg.Limit) && len(level) > 0; depth++ {
+		next := []string{}
+		for _, id := range level {
+			for _, childID := range children.Children(id) {
+				if sent >= maxTreeQueryResults {
+					finish(msg, client)
+					return
+				}
+				if child := store.Get(childID); child != nil {
+					respond(msg, child, client)
+					sent++
+					next = append(next, childID)
+				}
+			}
+		}
+		level = next
+	}
+	finish(msg, client)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	. "github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
+)
+
+const (
+	// upstreamBatchSize is the number of ancestors requested from the
+	// upstream server at once.
+	upstreamBatchSize = 128
+	// upstreamRelayQueueSize is the number of local messages that may wait
+	// to be relayed upstream, including while the upstream server cannot
+	// be reached.
+	upstreamRelayQueueSize = 1024
+	// maxUpstreamBackoff is the longest wait between attempts to reconnect
+	// to the upstream server.
+	maxUpstreamBackoff = time.Minute
+)
+
+// newServerID creates a random identifier for this server, which is used to
+// recognize the messages that it has relayed.
+func newServerID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", errors.Wrap(err, "Unable to create server ID")
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Upstream mirrors the rooms of another arbor server, which it connects to
+// as a client. Messages from the upstream server are added to the local store
+// and broadcast to local clients, while messages posted locally in a mirrored
+// room are relayed to the upstream server.
+//
+// Every message that crosses between the servers is marked with the ID of
+// the server relaying it, so that it is never relayed back to a server that
+// has already seen it.
+type Upstream struct {
+	address  string
+	config   *transport.ClientConfig
+	framing  Framing
+	id       string
+	rooms    *Rooms
+	store    Store
+	children *ChildIndex
+	journal  *Journal
+	// token is sent to the upstream server to identify this server as its
+	// peer
+	token string
+	// first is the connection made by Connect, which Run starts with
+	first *upstreamConn
+	// relays holds local messages waiting to be sent upstream
+	relays chan *ArborMessage
+	// mirrored holds the names of the rooms whose roots match those upstream.
+	// The lock also ensures that each upstream message is only added once.
+	mirrored map[string]bool
+	sync.Mutex
+}
+
+func NewUpstream(address string, config *transport.ClientConfig, framing Framing, id, token string, rooms *Rooms, store Store, children *ChildIndex, journal *Journal) *Upstream {
+	return &Upstream{
+		address:  address,
+		config:   config,
+		framing:  framing,
+		id:       id,
+		token:    token,
+		rooms:    rooms,
+		store:    store,
+		children: children,
+		journal:  journal,
+		relays:   make(chan *ArborMessage, upstreamRelayQueueSize),
+		mirrored: make(map[string]bool),
+	}
+}
+
+// upstreamConn is a single connection to the upstream server.
+type upstreamConn struct {
+	*peerConn
+	// mirrored holds the names of the rooms mirrored over this connection
+	mirrored []string
+	// done is closed once the connection has stopped delivering messages
+	done chan struct{}
+}
+
+// Connect makes the first connection to the upstream server and adopts the
+// roots of its rooms. It should be called after the rooms are restored from
+// the store, so that those mirrored before are recognized, but before any new
+// local rooms are created, so that the upstream roots are used instead.
+func (u *Upstream) Connect() error {
+	c, err := u.connect()
+	if err != nil {
+		return err
+	}
+	u.first = c
+	return nil
+}
+
+// Run mirrors the upstream server until the process exits, reconnecting
+// whenever the connection is lost.
+func (u *Upstream) Run() {
+	c := u.first
+	backoff := time.Second
+	for {
+		if c != nil {
+			backoff = time.Second
+			u.serve(c)
+			log.Println("Lost connection to upstream server", u.address)
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxUpstreamBackoff {
+			backoff = maxUpstreamBackoff
+		}
+		var err error
+		if c, err = u.connect(); err != nil {
+			log.Println("Unable to reconnect to upstream server:", err)
+		}
+	}
+}
+
+// connect dials the upstream server, agrees on a protocol version, and joins
+// each of the server's rooms.
+func (u *Upstream) connect() (*upstreamConn, error) {
+	peer, err := dialPeer(u.address, u.config, u.framing, u.token)
+	if err != nil {
+		return nil, err
+	}
+	c := &upstreamConn{
+		peerConn: peer,
+		done:     make(chan struct{}),
+	}
+	go u.read(c)
+	if err := u.join(c); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	log.Println("Connected to upstream server", u.address)
+	return c, nil
+}
+
+// join joins each of the upstream server's rooms, so that their new messages
+// are received, and adopts their roots.
+func (u *Upstream) join(c *upstreamConn) error {
+	names := c.welcome.Rooms
+	if len(names) == 0 {
+		names = []string{DefaultRoom}
+	}
+	for _, name := range names {
+		reply, err := request(c.requester, &ArborMessage{Type: JOIN, Room: name}, JOIN)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to join upstream room %s", name)
+		}
+		root, err := request(c.requester, &ArborMessage{Type: QUERY, Message: &Message{UUID: reply.Root}}, NEW_MESSAGE)
+		if err != nil {
+			return errors.Wrapf(err, "Unable to fetch root of upstream room %s", name)
+		}
+		if root.Message == nil {
+			return errors.Errorf("Upstream server sent no root for room %s", name)
+		}
+		if err := root.Message.VerifyID(); err != nil {
+			return err
+		}
+		if u.adopt(name, root.Message) {
+			c.mirrored = append(c.mirrored, name)
+		}
+	}
+	return nil
+}
+
+// adopt makes root the root of the local room with the given name, creating
+// the room if it does not exist, and returns whether the room is mirrored. A
+// room that already exists with a different root is not mirrored.
+func (u *Upstream) adopt(name string, root *Message) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.mirrored[name] {
+		return true
+	}
+	room := u.rooms.Get(name)
+	if room == nil {
+		u.journal.Lock()
+		if err := u.store.Add(root); err != nil {
+			u.journal.Unlock()
+			log.Println("Unable to store root of upstream room", name, err)
+			return false
+		}
+		u.journal.Record(root.UUID)
+		u.journal.Unlock()
+		if room = u.rooms.Create(name, root); room == nil {
+			return false
+		}
+	} else if room.RootID != root.UUID {
+		log.Println("Not mirroring upstream room", name, "because its root differs from the local one")
+		return false
+	}
+	u.mirrored[name] = true
+	room.Broadcaster.Add(u)
+	return true
+}
+
+// serve mirrors the upstream server over c until the connection is lost.
+func (u *Upstream) serve(c *upstreamConn) {
+	defer c.conn.Close()
+	go u.catchUp(c)
+	for {
+		select {
+		case relay := <-u.relays:
+			c.requester.Send(relay)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// catchUp synchronizes each mirrored room with the upstream server, fetching
+// the messages that were posted upstream while the servers were apart and
+// relaying those that were posted here.
+func (u *Upstream) catchUp(c *upstreamConn) {
+	for _, name := range c.mirrored {
+		tree := &treeSync{
+			peer:     c.requester,
+			store:    u.store,
+			children: u.children,
+			accept: func(msg *Message) bool {
+				return u.accept(msg, nil)
+			},
+			push: func(msg *Message) {
+				u.relay(c, msg)
+			},
+		}
+		if err := tree.run(u.rooms.Get(name).RootID); err != nil {
+			log.Println("Unable to synchronize room", name, "with upstream server:", err)
+			return
+		}
+		if tree.pulled > 0 || tree.pushed > 0 {
+			log.Println("Synchronized room", name, "with upstream server, fetched", tree.pulled, "and relayed", tree.pushed, "messages")
+		}
+	}
+}
+
+// read handles each message from the upstream server until the connection
+// is lost.
+func (u *Upstream) read(c *upstreamConn) {
+	defer close(c.done)
+	defer c.requester.Close()
+	for msg := range c.in {
+		if c.requester.Handle(msg) {
+			continue
+		}
+		switch msg.Type {
+		case NEW_MESSAGE:
+			if msg.Message != nil {
+				u.receive(c, msg)
+			}
+		case PING:
+			c.pong(msg)
+		case ERROR:
+			log.Println("Error from upstream server:", msg.Reason)
+		case SHUTDOWN:
+			log.Println("Upstream server is shutting down:", msg.Reason)
+		}
+	}
+}
+
+// receive mirrors a message broadcast by the upstream server.
+func (u *Upstream) receive(c *upstreamConn, msg *ArborMessage) {
+	if msg.RelayedBy(u.id) || u.store.Get(msg.Message.UUID) != nil {
+		// it came from here, or arrived some other way
+		return
+	}
+	if u.store.Get(msg.Message.Parent) != nil {
+		u.accept(msg.Message, msg.Via)
+		return
+	}
+	// the missing ancestors must be requested from another goroutine, since
+	// this one delivers the responses
+	go func() {
+		if err := u.fetch(c, msg.Message.UUID); err != nil {
+			log.Println("Unable to fetch upstream message", msg.Message.UUID, err)
+		}
+	}()
+}
+
+// fetch mirrors the upstream message with the given id, along with any of its
+// ancestors that are missing locally.
+func (u *Upstream) fetch(c *upstreamConn, id string) error {
+	// missing holds the messages to add, nearest to id first
+	var missing []*Message
+	next := id
+	for next != "" && u.store.Get(next) == nil {
+		batch, err := c.ancestry(next)
+		if err != nil {
+			return err
+		}
+		if len(batch) == 0 || batch[0].UUID != next {
+			return errors.Errorf("Upstream server did not send message %s", next)
+		}
+		for i, msg := range batch {
+			if i > 0 && batch[i-1].Parent != msg.UUID {
+				return errors.Errorf("Upstream server sent message %s out of order", msg.UUID)
+			}
+			if u.store.Get(msg.UUID) != nil {
+				break
+			}
+			missing = append(missing, msg)
+			next = msg.Parent
+		}
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		if !u.accept(missing[i], nil) {
+			return errors.Errorf("Message %s is not in a mirrored room", missing[i].UUID)
+		}
+	}
+	return nil
+}
+
+// accept adds msg, whose parent must already be present, to the local store
+// and broadcasts it to local clients. It returns false if msg was not added,
+// which is also the case if it was already present.
+func (u *Upstream) accept(msg *Message, via []string) bool {
+	u.Lock()
+	defer u.Unlock()
+	if u.store.Get(msg.UUID) != nil {
+		return false
+	}
+	parent := u.store.Get(msg.Parent)
+	room := u.rooms.Of(msg.Parent)
+	if parent == nil || room == nil || !u.mirrored[room.Name] {
+		return false
+	}
+	if err := msg.VerifyID(); err != nil {
+		log.Println("Discarding upstream message:", err)
+		return false
+	}
+	if msg.VerifySignature() == Invalid {
+		log.Println("Discarding upstream message with invalid signature", msg.UUID)
+		return false
+	}
+	msg.Depth = parent.Depth + 1
+	u.journal.Lock()
+	defer u.journal.Unlock()
+	if err := u.store.Add(msg); err != nil {
+		log.Println("Error storing upstream message", err)
+		return false
+	}
+	seq := u.journal.Record(msg.UUID)
+	u.children.Add(msg)
+	if room = u.rooms.Add(msg); room == nil {
+		return true
+	}
+	room.Broadcaster.Send(&ArborMessage{
+		Type:    NEW_MESSAGE,
+		Room:    room.Name,
+		Via:     append(append([]string(nil), via...), u.id),
+		Seq:     seq,
+		Prev:    room.Next(seq),
+		Message: msg,
+	})
+	return true
+}
+
+// Send queues a message that was broadcast in a mirrored room to be relayed
+// to the upstream server, unless it came from there. It never blocks, so that
+// the Broadcaster never considers the upstream server to be a slow client.
+func (u *Upstream) Send(msg *ArborMessage) bool {
+	if msg.Message == nil || msg.RelayedBy(u.id) {
+		return true
+	}
+	u.enqueue(&ArborMessage{
+		Type:    NEW_MESSAGE,
+		Via:     append(append([]string(nil), msg.Via...), u.id),
+		Message: msg.Message,
+	})
+	return true
+}
+
+// relay sends a message from the local store upstream over c. Rather than
+// being queued, where it could be dropped if the upstream server is missing
+// many messages, it is sent straight away, waiting for the connection.
+func (u *Upstream) relay(c *upstreamConn, msg *Message) {
+	c.requester.Send(&ArborMessage{
+		Type:    NEW_MESSAGE,
+		Via:     []string{u.id},
+		Message: msg,
+	})
+}
+
+func (u *Upstream) enqueue(relay *ArborMessage) {
+	select {
+	case u.relays <- relay:
+	default:
+		log.Println("Too many messages waiting for upstream server, not relaying", relay.Message.UUID)
+	}
+}
+
+// Close is called if a Broadcaster evicts the upstream server, which cannot
+// happen since Send never blocks.
+func (u *Upstream) Close() {}
+
+func (u *Upstream) String() string {
+	return fmt.Sprintf("upstream server %s", u.address)
+}
+
+// ancestry requests the message with the given id and up to
+// upstreamBatchSize of its ancestors, nearest first.
+func (c *upstreamConn) ancestry(id string) ([]*Message, error) {
+	var batch []*Message
+	err := await(c.requester, &ArborMessage{
+		Type:    ANCESTRY,
+		Limit:   upstreamBatchSize,
+		Message: &Message{UUID: id},
+	}, DONE, func(response *ArborMessage) {
+		if response.Type == NEW_MESSAGE && response.Message != nil {
+			batch = append(batch, response.Message)
+		}
+	})
+	return batch, err
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
+)
+
+// listen accepts connections to server on a local port until the test ends,
+// and returns its address.
+func listen(t *testing.T, server *Server) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			server.Serve(conn, NewlineFraming)
+		}
+	}()
+	t.Cleanup(func() { listener.Close() })
+	return listener.Addr().String()
+}
+
+func TestMirroredRoomsSurviveRestart(t *testing.T) {
+	upstream := newTestServer(t)
+	defer upstream.Shutdown(time.Second)
+	if err := createRooms(upstream.store, upstream.journal, upstream.rooms, []string{"foo"}); err != nil {
+		t.Fatal(err)
+	}
+	address := listen(t, upstream)
+	fooRoot := upstream.rooms.Get("foo").RootID
+	path := filepath.Join(t.TempDir(), "edge.log")
+
+	// the edge server saves the upstream roots when it first starts, and
+	// finds them in its store when it starts again
+	for start := 1; start <= 2; start++ {
+		store, err := openStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		children := NewChildIndex()
+		journal := NewJournal()
+		rooms := NewRooms(4, DropOldest)
+		mirror := NewUpstream(address, &transport.ClientConfig{}, NewlineFraming, "edge", "", rooms, store, children, journal)
+		if err := restoreRooms(store, children, journal, rooms, mirror); err != nil {
+			t.Fatal(err)
+		}
+		if mirror.first == nil {
+			t.Fatalf("Start %d did not connect to the upstream server", start)
+		}
+		if room := rooms.Of(fooRoot); room == nil || room.Name != "foo" {
+			t.Errorf("Start %d placed the root of room foo in %v", start, room)
+		}
+		if roots := children.Children(""); len(roots) != 0 {
+			t.Errorf("Start %d recorded roots %v as replies", start, roots)
+		}
+		for _, id := range rooms.Default().Recents.Data() {
+			if id == fooRoot {
+				t.Errorf("Start %d made the root of room foo a recent message of the default room", start)
+			}
+		}
+		mirror.first.conn.Close()
+		if err := closeStore(store); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
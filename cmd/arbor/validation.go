@@ -0,0 +1,181 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+const (
+	defaultMaxContentLength  = 8192
+	defaultMaxUsernameLength = 64
+	defaultMaxClockSkew      = 5 * time.Minute
+	defaultMaxAge            = 24 * time.Hour
+)
+
+// rejection explains why a new message was not accepted.
+type rejection struct {
+	code   ErrorCode
+	reason string
+	// id is the message ID that the rejection concerns, if any
+	id string
+}
+
+// Validator decides whether a NEW_MESSAGE from a client may be accepted.
+type Validator struct {
+	// MaxContentLength and MaxUsernameLength are the longest permitted
+	// Content and Username, in bytes.
+	MaxContentLength  int
+	MaxUsernameLength int
+	// MaxClockSkew is how far in the future a message's Timestamp may be,
+	// and MaxAge is how far in the past. A MaxAge of zero permits any
+	// Timestamp in the past. MaxAge does not apply to messages relayed by
+	// another server, which may have been posted while the servers were
+	// apart. Only peer servers may send messages with a Via field.
+	MaxClockSkew time.Duration
+	MaxAge       time.Duration
+	// ServerID identifies this server in the Via field of relayed messages.
+	// Messages that it has already relayed are rejected, since they can
+	// only have returned by going around a loop of servers.
+	ServerID string
+	// Follower, if set, is replicating another server, and new messages are
+	// refused until it is promoted.
+	Follower *Follower
+	store    Store
+}
+
+// NewValidator creates a Validator with the default limits that checks the
+// parents of new messages against store.
+func NewValidator(store Store) *Validator {
+	return &Validator{
+		MaxContentLength:  defaultMaxContentLength,
+		MaxUsernameLength: defaultMaxUsernameLength,
+		MaxClockSkew:      defaultMaxClockSkew,
+		MaxAge:            defaultMaxAge,
+		store:             store,
+	}
+}
+
+// validationStage is one of the checks made by a Validator. It returns nil if
+// msg is acceptable.
+type validationStage func(v *Validator, msg *ArborMessage) *rejection
+
+// validationPipeline lists the checks made on every new message, in order.
+// Checks that need to consult the store come last.
+var validationPipeline = []validationStage{
+	checkType,
+	checkFollower,
+	checkVia,
+	checkID,
+	checkContent,
+	checkUsername,
+	checkTimestamp,
+	checkMetadata,
+	checkSignature,
+	checkParent,
+}
+
+// Validate runs msg through every stage of the validation pipeline, and
+// returns the first reason that it is unacceptable, or nil if it passes.
+func (v *Validator) Validate(msg *ArborMessage) *rejection {
+	for _, stage := range validationPipeline {
+		if r := stage(v, msg); r != nil {
+			return r
+		}
+	}
+	return nil
+}
+
+func checkType(v *Validator, msg *ArborMessage) *rejection {
+	if msg.Type != NEW_MESSAGE {
+		return &rejection{code: ERR_INVALID_FIELD, reason: fmt.Sprintf("Expected a message of type %d, got %d", NEW_MESSAGE, msg.Type)}
+	}
+	if msg.Message == nil {
+		return &rejection{code: ERR_MALFORMED, reason: "Message has no message fields"}
+	}
+	return nil
+}
+
+func checkFollower(v *Validator, msg *ArborMessage) *rejection {
+	if v.Follower != nil && v.Follower.Following() {
+		return &rejection{code: ERR_READ_ONLY, reason: "This server is a read-only copy of another server"}
+	}
+	return nil
+}
+
+func checkVia(v *Validator, msg *ArborMessage) *rejection {
+	if v.ServerID != "" && msg.RelayedBy(v.ServerID) {
+		return &rejection{code: ERR_INVALID_FIELD, reason: "Message has already been relayed by this server"}
+	}
+	return nil
+}
+
+// checkID rejects messages whose client chose their UUID, unless it is the
+// content-addressed ID that the server would have assigned anyway.
+func checkID(v *Validator, msg *ArborMessage) *rejection {
+	if msg.Message.UUID != "" && msg.Message.UUID != msg.Message.ComputeID() {
+		return &rejection{code: ERR_INVALID_FIELD, reason: "The UUID of a new message is assigned by the server"}
+	}
+	return nil
+}
+
+func checkContent(v *Validator, msg *ArborMessage) *rejection {
+	if msg.Message.Content == "" {
+		return &rejection{code: ERR_INVALID_FIELD, reason: "Message content is empty"}
+	}
+	if len(msg.Message.Content) > v.MaxContentLength {
+		return &rejection{code: ERR_INVALID_FIELD, reason: fmt.Sprintf("Message content is %d bytes, limit is %d", len(msg.Message.Content), v.MaxContentLength)}
+	}
+	return nil
+}
+
+func checkUsername(v *Validator, msg *ArborMessage) *rejection {
+	if len(msg.Message.Username) > v.MaxUsernameLength {
+		return &rejection{code: ERR_INVALID_FIELD, reason: fmt.Sprintf("Username is %d bytes, limit is %d", len(msg.Message.Username), v.MaxUsernameLength)}
+	}
+	return nil
+}
+
+func checkTimestamp(v *Validator, msg *ArborMessage) *rejection {
+	now := time.Now()
+	sent := time.Unix(msg.Message.Timestamp, 0)
+	if sent.After(now.Add(v.MaxClockSkew)) {
+		return &rejection{code: ERR_INVALID_TIMESTAMP, reason: fmt.Sprintf("Message timestamp is more than %s in the future", v.MaxClockSkew)}
+	}
+	if v.MaxAge > 0 && len(msg.Via) == 0 && sent.Before(now.Add(-v.MaxAge)) {
+		return &rejection{code: ERR_INVALID_TIMESTAMP, reason: fmt.Sprintf("Message timestamp is more than %s in the past", v.MaxAge)}
+	}
+	return nil
+}
+
+func checkMetadata(v *Validator, msg *ArborMessage) *rejection {
+	if err := msg.Message.ValidateMetadata(); err != nil {
+		return &rejection{code: ERR_INVALID_METADATA, reason: err.Error()}
+	}
+	if _, ok := msg.Message.Metadata[RoomKey]; ok {
+		// otherwise a parentless message could become a room's root when
+		// the server restarts
+		return &rejection{code: ERR_INVALID_METADATA, reason: "Metadata key " + RoomKey + " is reserved for the roots of rooms"}
+	}
+	return nil
+}
+
+func checkSignature(v *Validator, msg *ArborMessage) *rejection {
+	if msg.Message.VerifySignature() == Invalid {
+		return &rejection{code: ERR_INVALID_SIGNATURE, reason: "Message signature does not match its contents"}
+	}
+	return nil
+}
+
+// checkParent rejects messages that are not replies to a known message, since
+// they would be orphaned within every client's tree.
+func checkParent(v *Validator, msg *ArborMessage) *rejection {
+	if msg.Message.Parent == "" {
+		return &rejection{code: ERR_UNKNOWN_PARENT, reason: "New messages must have a parent"}
+	}
+	if v.store.Get(msg.Message.Parent) == nil {
+		return &rejection{code: ERR_UNKNOWN_PARENT, reason: "No message with id " + msg.Message.Parent, id: msg.Message.Parent}
+	}
+	return nil
+}
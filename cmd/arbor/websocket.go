@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+var upgrader = websocket.Upgrader{
+	// Arbor does not authenticate clients with cookies, so a page on another
+	// site gains nothing by connecting on behalf of its visitor that it
+	// could not get by connecting itself.
+	CheckOrigin: func(*http.Request) bool { return true },
+}
+
+// webSocketHandler accepts WebSocket connections and serves them as Arbor
+// clients of server.
+func webSocketHandler(server *Server) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ws, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// the upgrader has already responded with an HTTP error
+			log.Println("Unable to accept WebSocket connection", err)
+			return
+		}
+		ws.SetReadLimit(MaxMessageSize)
+		server.Serve(&wsConn{Conn: ws}, NewlineFraming)
+	}
+}
+
+// wsConn carries Arbor messages over a WebSocket connection, with each
+// message in its own text frame. It presents the frames as a stream of
+// newline-delimited JSON so that it can be used with a NewlineFraming Codec.
+type wsConn struct {
+	*websocket.Conn
+	// frame is the remainder of the frame currently being read
+	frame io.Reader
+	// separate is set when a newline must be read before the next frame
+	separate bool
+}
+
+func (c *wsConn) Read(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	for {
+		if c.frame == nil {
+			if c.separate {
+				c.separate = false
+				p[0] = '\n'
+				return 1, nil
+			}
+			_, frame, err := c.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			c.frame = frame
+			c.separate = true
+		}
+		n, err := c.frame.Read(p)
+		if err == io.EOF {
+			c.frame = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+// Write sends p as a single frame. Codec writes each newline-framed message
+// with one call to Write.
+func (c *wsConn) Write(p []byte) (int, error) {
+	if err := c.WriteMessage(websocket.TextMessage, bytes.TrimSuffix(p, []byte("\n"))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *wsConn) SetDeadline(t time.Time) error {
+	if err := c.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.SetWriteDeadline(t)
+}
+
+// Close tells the client that the connection is ending before closing it.
+func (c *wsConn) Close() error {
+	message := websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")
+	c.WriteControl(websocket.CloseMessage, message, time.Now().Add(time.Second))
+	return c.Conn.Close()
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	. "github.com/whereswaldon/arbor/lib/messages"
+)
+
+func TestWebSocketRoundTrip(t *testing.T) {
+	server := newTestServer(t)
+	defer server.Shutdown(time.Second)
+	httpServer := httptest.NewServer(webSocketHandler(server))
+	defer httpServer.Close()
+	ws, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(httpServer.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	welcome := &ArborMessage{}
+	if err := ws.ReadJSON(welcome); err != nil {
+		t.Fatal(err)
+	}
+	if welcome.Type != WELCOME || welcome.Root != server.rooms.Default().RootID {
+		t.Fatalf("Expected a WELCOME to the default room, got %s", welcome)
+	}
+
+	reply := &Message{
+		Parent:    welcome.Root,
+		Content:   "Hello over WebSocket",
+		Username:  "tester",
+		Timestamp: time.Now().Unix(),
+	}
+	if err := ws.WriteJSON(&ArborMessage{Type: NEW_MESSAGE, Message: reply}); err != nil {
+		t.Fatal(err)
+	}
+	received := &ArborMessage{}
+	if err := ws.ReadJSON(received); err != nil {
+		t.Fatal(err)
+	}
+	if received.Type != NEW_MESSAGE || received.Message == nil {
+		t.Fatalf("Expected the new message to be broadcast, got %s", received)
+	}
+	if received.Message.Content != reply.Content || received.Message.UUID != reply.ComputeID() {
+		t.Errorf("Broadcast message %s does not match the one sent", received)
+	}
+	if server.store.Get(reply.ComputeID()) == nil {
+		t.Error("New message was not stored")
+	}
+}
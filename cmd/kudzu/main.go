@@ -1,51 +1,60 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
 	"fmt"
-	"io"
 	"log"
 	"math/rand"
-	"net"
 	"os"
 	"time"
 
 	"github.com/gambrell/lorem"
 	messages "github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
 )
 
 const replyThreshold = 0.5
 
 func main() {
-	if len(os.Args) < 2 {
-		log.Fatalln("Usage: " + os.Args[0] + " <host:port>")
+	framingName := flag.String("framing", messages.NewlineFraming.String(), "message framing used by the server (newline or length)")
+	tlsConfig := transport.AddClientFlags(flag.CommandLine)
+	flag.Parse()
+	if flag.NArg() < 1 {
+		log.Fatalln("Usage: " + os.Args[0] + " [flags] <host:port>")
 	}
-	conn, err := net.Dial("tcp", os.Args[1])
+	framing, err := messages.ParseFraming(*framingName)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	conn, err := transport.Dial(flag.Arg(0), tlsConfig)
 	if err != nil {
 		log.Fatalln("Unable to connect", err)
 		return
 	}
 
-	data := make([]byte, 1024)
+	codec := messages.NewCodec(framing)
+	fromServer := codec.MakeReader(conn)
+	toServer := codec.MakeWriter(conn)
+	toServer <- &messages.ArborMessage{
+		Type:     messages.VERSION,
+		Versions: messages.SupportedVersions,
+	}
 	replyCounter := 0
-	for {
-		n, err := conn.Read(data)
-		log.Println("read ", n, " bytes")
-		if err != nil {
-			if err == io.EOF {
-				log.Println("Connection to server closed, reader shutting down", err)
-				break
-			}
-			log.Println("unable to read message: ", err)
-			return
-		}
-		a := &messages.ArborMessage{}
-		err = json.Unmarshal(data[:n], a)
-		if err != nil {
-			log.Println("unable to decode message: ", err, string(data))
-			continue
-		}
+	for a := range fromServer {
 		switch a.Type {
+		case messages.WELCOME:
+			log.Println("Welcomed by server, root is ", a.Root)
+		case messages.VERSION:
+			if a.IsVersionRejection() {
+				log.Fatalln("Server refused protocol versions:", a.Reason)
+			}
+		case messages.SHUTDOWN:
+			log.Println("Server is shutting down:", a.Reason)
+		case messages.PING:
+			toServer <- &messages.ArborMessage{
+				Type:      messages.PONG,
+				RequestID: a.RequestID,
+			}
 		case messages.NEW_MESSAGE:
 			// choose whether to reply
 			if a.Message.UUID != "" && rand.Float64() < replyThreshold {
@@ -53,31 +62,22 @@ func main() {
 				a := &messages.ArborMessage{
 					Type: messages.NEW_MESSAGE,
 					Message: &messages.Message{
-    						Username: "kudzu",
-    						Timestamp: time.Now().Unix(),
-						Parent:  a.Message.UUID,
-						Content: fmt.Sprintf("%d", replyCounter) + lorem.Lorem(rand.Intn(128), "words", false),
+						Username:  "kudzu",
+						Timestamp: time.Now().Unix(),
+						Parent:    a.Message.UUID,
+						Content:   fmt.Sprintf("%d", replyCounter) + lorem.Lorem(rand.Intn(128), "words", false),
 					},
 				}
 				replyCounter++
-				data, err := json.Marshal(a)
-				if err != nil {
-					log.Println("Failed to marshal request", err)
-					continue
-				}
-				_, err = conn.Write(data)
-				if err != nil {
-					if err == io.EOF {
-						log.Println("Connection to server closed, writer shutting down", err)
-						break
-					}
-					log.Println("Failed to write request", err)
-					continue
+				if err := a.Message.SetMeta("arbor/bot", true); err != nil {
+					log.Println("Unable to mark reply as automated", err)
 				}
+				toServer <- a
 			}
 		default:
-			log.Println("Unknown message type: ", string(data))
+			log.Println("Unknown message type: ", a.String())
 			continue
 		}
 	}
+	log.Println("Connection to server closed, shutting down")
 }
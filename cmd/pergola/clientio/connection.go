@@ -0,0 +1,307 @@
+package clientio
+
+import (
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	messages "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// MinBackoff and MaxBackoff bound how long a Connection waits before trying
+// to reconnect. The wait doubles after each failed attempt.
+const (
+	MinBackoff = time.Second
+	MaxBackoff = time.Minute
+)
+
+// Status describes the state of the client's connection to the server.
+type Status int
+
+const (
+	// Connecting means that the client has not yet connected.
+	Connecting Status = iota
+	// Connected means that the client is connected to the server.
+	Connected
+	// Stale means that the client is connected, but has heard nothing from
+	// the server for StaleAfter.
+	Stale
+	// Reconnecting means that the connection was lost, and the client is
+	// trying to connect again.
+	Reconnecting
+	// Offline means that the client is waiting before it next tries to
+	// connect.
+	Offline
+)
+
+func (s Status) String() string {
+	switch s {
+	case Connecting:
+		return "Connecting"
+	case Connected:
+		return "Connected"
+	case Stale:
+		return "Stale"
+	case Reconnecting:
+		return "Reconnecting"
+	case Offline:
+		return "Offline"
+	}
+	return "Unknown"
+}
+
+// ConnectionState is a snapshot of the client's connection to the server.
+type ConnectionState struct {
+	Status Status
+	// LastHeard is when a message last arrived from the server
+	LastHeard time.Time
+	// RetryAt is when the client will next try to connect, if it is Offline
+	RetryAt time.Time
+	// Queued is the number of new messages that the server has not yet
+	// responded to
+	Queued int
+}
+
+// Connection maintains the client's connection to the server, reconnecting
+// whenever it is lost. Each connection delivers the messages that it receives
+// to the same channels, and begins where the previous one ended: the client
+// rejoins its room, resumes from the last message that it received there, and
+// sends again any new messages that the server never responded to.
+type Connection struct {
+	dial     func() (io.ReadWriteCloser, error)
+	framing  messages.Framing
+	liveness *Liveness
+	position *Position
+	outbox   *Outbox
+	msgs     chan<- *messages.Message
+	welcomes chan<- *messages.ArborMessage
+	errs     chan<- *messages.ArborMessage
+	states   chan<- ConnectionState
+	// codec and requester belong to the current connection, and are nil while
+	// there is none. They, status and retryAt are guarded by the lock.
+	codec     *messages.Codec
+	requester *messages.Requester
+	status    Status
+	retryAt   time.Time
+	sync.Mutex
+}
+
+// NewConnection creates a Connection that uses dial to connect to the server.
+// New messages, ERRORs and the messages describing the client's room are
+// written to msgs, errs and welcomes as described by HandleNewMessages, except
+// that replies to VERSION are not. Each change in the state of the connection
+// is written to states.
+func NewConnection(dial func() (io.ReadWriteCloser, error), framing messages.Framing, msgs chan<- *messages.Message, welcomes, errs chan<- *messages.ArborMessage, states chan<- ConnectionState) *Connection {
+	return &Connection{
+		dial:     dial,
+		framing:  framing,
+		liveness: NewLiveness(),
+		position: NewPosition(),
+		outbox:   NewOutbox(),
+		msgs:     msgs,
+		welcomes: welcomes,
+		errs:     errs,
+		states:   states,
+	}
+}
+
+// Run connects to the server, and connects again whenever the connection is
+// lost. It never returns.
+func (c *Connection) Run() {
+	backoff := MinBackoff
+	status := Connecting
+	for {
+		c.report(status, time.Time{})
+		conn, err := c.dial()
+		if err != nil {
+			log.Println("Unable to connect:", err)
+		} else {
+			backoff = MinBackoff
+			c.serve(conn)
+			log.Println("Lost connection to server")
+		}
+		status = Reconnecting
+		c.report(Offline, time.Now().Add(backoff))
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > MaxBackoff {
+			backoff = MaxBackoff
+		}
+	}
+}
+
+// serve exchanges messages with the server over conn until it is closed.
+func (c *Connection) serve(conn io.ReadWriteCloser) {
+	codec := messages.NewCodec(c.framing)
+	requester := messages.NewRequester(codec.MakeWriter(conn))
+	defer func() {
+		conn.Close()
+		// the writer discards whatever it is still sent once conn is
+		// closed, so stopping it cannot wait long
+		requester.Stop()
+	}()
+	// where the previous connection, if any, left off
+	room, seq := c.position.Get()
+	welcomes := make(chan *messages.ArborMessage)
+	done := make(chan struct{})
+	c.liveness.Heard()
+	go func() {
+		HandleNewMessages(conn, codec, requester, c.liveness, c.position, c.outbox, c.msgs, welcomes, c.errs)
+		close(done)
+	}()
+	requester.Send(&messages.ArborMessage{
+		Type:     messages.VERSION,
+		Versions: messages.SupportedVersions,
+	})
+	defer c.disconnect()
+	stale := make(chan bool)
+	rejoinFailed := make(chan struct{})
+	// a half-open connection is never closed by the other end, so it is
+	// closed here once the server has been silent for too long
+	checks := time.NewTicker(PingInterval)
+	defer checks.Stop()
+	// welcome is the server's WELCOME while it is withheld because the client
+	// is rejoining its previous room, which needs the server's version
+	var welcome *messages.ArborMessage
+	welcomed, negotiated := false, false
+	// catchUp rejoins the previous room, or resumes from the last message
+	// received there, once the WELCOME and the server's version have arrived
+	catchUp := func() {
+		if !welcomed || !negotiated {
+			return
+		}
+		if welcome != nil {
+			go c.rejoin(requester, room, rejoinFailed)
+		} else if current, _ := c.position.Get(); current == room {
+			go Resume(codec, requester, room, seq)
+		}
+	}
+	for {
+		select {
+		case msg := <-welcomes:
+			switch {
+			case msg.Type == messages.VERSION:
+				if !msg.IsVersionRejection() {
+					negotiated = true
+					catchUp()
+				}
+			case msg.Type == messages.WELCOME && !welcomed:
+				welcomed = true
+				c.connect(codec, requester)
+				go KeepAlive(codec, requester, c.liveness, stale, done)
+				for _, pending := range c.outbox.Pending() {
+					post(requester, pending)
+				}
+				if room != "" && msg.Room != room {
+					welcome = msg
+				} else {
+					c.enter(msg)
+				}
+				catchUp()
+			case msg.Type == messages.JOIN && welcome != nil && msg.Room == room:
+				requester.Send(&messages.ArborMessage{
+					Type: messages.LEAVE,
+					Room: welcome.Room,
+				})
+				welcome = nil
+				c.enter(msg)
+				go Resume(codec, requester, room, seq)
+			default:
+				c.enter(msg)
+			}
+		case <-rejoinFailed:
+			if welcome != nil {
+				c.enter(welcome)
+				welcome = nil
+			}
+		case isStale := <-stale:
+			if isStale {
+				c.report(Stale, time.Time{})
+				continue
+			}
+			c.report(Connected, time.Time{})
+			// the server may have dropped messages that it could not
+			// deliver while the connection was stale
+			current, last := c.position.Get()
+			go Resume(codec, requester, current, last)
+		case <-checks.C:
+			// servers that predate PING may just be quiet
+			if codec.Version().Supports(messages.PING) && time.Since(c.liveness.LastHeard()) >= DeadAfter {
+				log.Println("Heard nothing from server for", DeadAfter, "closing connection")
+				conn.Close()
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// rejoin asks to join the named room, and closes failed if the server
+// refuses. The reply is delivered by HandleNewMessages.
+func (c *Connection) rejoin(requester *messages.Requester, room string, failed chan<- struct{}) {
+	for response := range requester.Request(&messages.ArborMessage{
+		Type: messages.JOIN,
+		Room: room,
+	}) {
+		if response.Type == messages.ERROR {
+			log.Println("Unable to rejoin", room, response.Reason)
+			close(failed)
+		}
+	}
+}
+
+// enter records that the client is now in the room described by msg, and
+// passes msg on.
+func (c *Connection) enter(msg *messages.ArborMessage) {
+	c.position.Enter(msg.Room, msg.Seq)
+	c.welcomes <- msg
+}
+
+// connect makes codec and requester those of the current connection.
+func (c *Connection) connect(codec *messages.Codec, requester *messages.Requester) {
+	c.Lock()
+	c.codec = codec
+	c.requester = requester
+	c.status = Connected
+	c.Unlock()
+	c.publish()
+}
+
+// disconnect records that there is no longer a current connection.
+func (c *Connection) disconnect() {
+	c.Lock()
+	defer c.Unlock()
+	c.codec = nil
+	c.requester = nil
+}
+
+// current returns the codec and requester of the current connection, or nils
+// if there is none.
+func (c *Connection) current() (*messages.Codec, *messages.Requester) {
+	c.Lock()
+	defer c.Unlock()
+	return c.codec, c.requester
+}
+
+// report records the status of the connection, and when the client will next
+// try to connect if it is Offline.
+func (c *Connection) report(status Status, retryAt time.Time) {
+	c.Lock()
+	c.status = status
+	c.retryAt = retryAt
+	c.Unlock()
+	c.publish()
+}
+
+// publish writes the state of the connection to the states channel.
+func (c *Connection) publish() {
+	c.Lock()
+	state := ConnectionState{
+		Status:    c.status,
+		LastHeard: c.liveness.LastHeard(),
+		RetryAt:   c.retryAt,
+		Queued:    c.outbox.Len(),
+	}
+	c.Unlock()
+	c.states <- state
+}
@@ -0,0 +1,73 @@
+package clientio
+
+import (
+	"sync"
+	"time"
+
+	messages "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// PingInterval is how often KeepAlive pings the server.
+const PingInterval = 15 * time.Second
+
+// StaleAfter is how long the server may be silent before KeepAlive reports
+// the connection as stale. It allows several pings to go unanswered.
+const StaleAfter = 3 * PingInterval
+
+// DeadAfter is how long a server that answers PINGs may be silent before the
+// connection is given up for lost and closed, so that a new one is made.
+const DeadAfter = 2 * StaleAfter
+
+// Liveness records when the server was last heard from.
+type Liveness struct {
+	lastHeard time.Time
+	sync.Mutex
+}
+
+func NewLiveness() *Liveness {
+	return &Liveness{lastHeard: time.Now()}
+}
+
+// Heard records that a message has just arrived from the server.
+func (l *Liveness) Heard() {
+	l.Lock()
+	defer l.Unlock()
+	l.lastHeard = time.Now()
+}
+
+// LastHeard returns when a message last arrived from the server.
+func (l *Liveness) LastHeard() time.Time {
+	l.Lock()
+	defer l.Unlock()
+	return l.lastHeard
+}
+
+// KeepAlive pings the server every PingInterval, so that a healthy server
+// always has something to answer, and sends on stale whenever the connection
+// becomes stale (nothing has been heard for StaleAfter) or recovers. Servers
+// that predate PING are not pinged, so their connections may appear stale
+// when they are merely quiet. It returns once done is closed.
+func KeepAlive(codec *messages.Codec, requester *messages.Requester, liveness *Liveness, stale chan<- bool, done <-chan struct{}) {
+	ticker := time.NewTicker(PingInterval)
+	defer ticker.Stop()
+	wasStale := false
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if codec.Version().Supports(messages.PING) {
+			requester.Send(&messages.ArborMessage{Type: messages.PING})
+		}
+		isStale := time.Since(liveness.LastHeard()) >= StaleAfter
+		if isStale != wasStale {
+			wasStale = isStale
+			select {
+			case stale <- isStale:
+			case <-done:
+				return
+			}
+		}
+	}
+}
@@ -3,52 +3,160 @@ package clientio
 import (
 	"io"
 	"log"
+	"sync"
+	"time"
 
 	messages "github.com/whereswaldon/arbor/lib/messages"
 )
 
 // HandleConn reads from the provided connection and writes new messages to the msgs
-// channel as they come in.
-func HandleNewMessages(conn io.ReadWriteCloser, msgs chan<- *messages.Message, welcomes chan<- *messages.ArborMessage) {
-	readMessages := messages.MakeMessageReader(conn)
-	defer close(msgs)
+// channel as they come in, room descriptions and VERSION replies to welcomes, and
+// errors to errs. It returns once the connection is closed, leaving the channels open.
+func HandleNewMessages(conn io.ReadWriteCloser, codec *messages.Codec, requester *messages.Requester, liveness *Liveness, position *Position, outbox *Outbox, msgs chan<- *messages.Message, welcomes, errs chan<- *messages.ArborMessage) {
+	readMessages := codec.MakeReader(conn)
+	defer requester.Close()
 	for fromServer := range readMessages {
+		liveness.Heard()
+		requester.Handle(fromServer)
 		switch fromServer.Type {
-		case messages.WELCOME:
+		case messages.WELCOME, messages.JOIN:
 			welcomes <- fromServer
-			close(welcomes)
-			welcomes = nil
+		case messages.LEAVE, messages.LIST_ROOMS, messages.PONG, messages.DONE:
+			// replies to requests that need no further action
+		case messages.PING:
+			// sent from another goroutine so that reading never waits on writing
+			go requester.Send(&messages.ArborMessage{
+				Type:      messages.PONG,
+				RequestID: fromServer.RequestID,
+			})
 		case messages.NEW_MESSAGE:
+			if fromServer.Message == nil {
+				log.Println("Discarding NEW_MESSAGE without message fields")
+				continue
+			} else if err := fromServer.Message.VerifyID(); err != nil {
+				log.Println("Discarding message:", err)
+				continue
+			}
 			// add the new message
+			outbox.Remove(fromServer.Message.UUID)
 			msgs <- fromServer.Message
+			if from := position.Advance(fromServer.Room, fromServer.Seq, fromServer.Prev); from != 0 {
+				// the server dropped some messages while we were slow
+				go Resume(codec, requester, fromServer.Room, from)
+			}
+		case messages.ERROR:
+			// new messages are posted with their IDs as request IDs
+			if retry, wait := outbox.Refused(fromServer.RequestID, fromServer.Code); retry {
+				id := fromServer.RequestID
+				time.AfterFunc(wait, func() {
+					// it may have been sent again over a new connection
+					if pending := outbox.Get(id); pending != nil {
+						post(requester, pending)
+					}
+				})
+			}
+			errs <- fromServer
+		case messages.SHUTDOWN:
+			errs <- fromServer
+		case messages.VERSION:
+			if fromServer.IsVersionRejection() {
+				log.Println("Server refused protocol versions:", fromServer.Reason)
+			}
+			welcomes <- fromServer
 		default:
-			log.Println("Unknown message type: ", fromServer.String)
+			log.Println("Unknown message type: ", fromServer.String())
 			continue
 		}
 	}
 }
 
+// RoomChange asks to stop receiving new messages from the room named Leave
+// (if it is set) and to join the room named Join.
+type RoomChange struct {
+	Leave string
+	Join  string
+}
+
+// AncestryBatchSize is the number of ancestors requested along with each
+// queried message when the server supports tree queries.
+const AncestryBatchSize = 128
+
 // HandleRequests reads from the requestedIds and outbound channels and sends messages
-// to the server. Any message id received on the requestedIds channel will be queried
-// and any message received on the outbound channel will be sent as a new message
-func HandleRequests(conn io.ReadWriteCloser, requestedIds <-chan string, outbund <-chan *messages.Message) {
-	toServer := messages.MakeMessageWriter(conn)
+// to the server over the current connection. Any message id received on the requestedIds
+// channel will be queried (unless a query for it is already awaiting a response) along
+// with its ancestors, and any message received on the outbound channel will be held in
+// the outbox and sent as a new message. Each RoomChange received on roomChanges is sent
+// as LEAVE and JOIN requests. While there is no connection, queries and room changes
+// are dropped, since the interface repeats them as needed, and new messages wait in
+// the outbox for the next connection.
+func (c *Connection) HandleRequests(requestedIds <-chan string, outbund <-chan *messages.Message, roomChanges <-chan RoomChange) {
+	var inFlightLock sync.Mutex
+	inFlight := make(map[string]struct{})
 	for {
 		select {
 		case queryId := <-requestedIds:
-			a := &messages.ArborMessage{
-				Type: messages.QUERY,
-				Message: &messages.Message{
-					UUID: queryId,
-				},
+			codec, requester := c.current()
+			if requester == nil {
+				continue
 			}
-			toServer <- a
+			inFlightLock.Lock()
+			_, waiting := inFlight[queryId]
+			inFlight[queryId] = struct{}{}
+			inFlightLock.Unlock()
+			if waiting {
+				continue
+			}
+			var responses <-chan *messages.ArborMessage
+			if codec.Version().Supports(messages.ANCESTRY) {
+				responses = requester.Request(&messages.ArborMessage{
+					Type:    messages.ANCESTRY,
+					Limit:   AncestryBatchSize,
+					Message: &messages.Message{UUID: queryId},
+				})
+			} else {
+				responses = requester.Query(queryId)
+			}
+			go func(id string) {
+				// the responses themselves are delivered by HandleNewMessages
+				for range responses {
+				}
+				inFlightLock.Lock()
+				delete(inFlight, id)
+				inFlightLock.Unlock()
+			}(queryId)
 		case newMesg := <-outbund:
-			a := &messages.ArborMessage{
-				Type:    messages.NEW_MESSAGE,
-				Message: newMesg,
+			c.outbox.Add(newMesg)
+			if _, requester := c.current(); requester != nil {
+				post(requester, newMesg)
+			} else {
+				c.publish()
+			}
+		case change := <-roomChanges:
+			_, requester := c.current()
+			if requester == nil {
+				log.Println("Unable to join", change.Join, "while disconnected")
+				continue
+			}
+			if change.Leave != "" {
+				discardResponses(requester.Request(&messages.ArborMessage{
+					Type: messages.LEAVE,
+					Room: change.Leave,
+				}))
 			}
-			toServer <- a
+			// the reply is delivered by HandleNewMessages
+			discardResponses(requester.Request(&messages.ArborMessage{
+				Type: messages.JOIN,
+				Room: change.Join,
+			}))
 		}
 	}
 }
+
+// discardResponses drains the responses to a request whose replies are
+// handled elsewhere.
+func discardResponses(responses <-chan *messages.ArborMessage) {
+	go func() {
+		for range responses {
+		}
+	}()
+}
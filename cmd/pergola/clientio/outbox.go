@@ -0,0 +1,110 @@
+package clientio
+
+import (
+	"sync"
+	"time"
+
+	messages "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// Outbox holds the new messages composed by the user until the server has
+// either accepted or refused them, so that those that were lost along with a
+// connection can be sent again over the next one. Since message IDs are
+// content-addressed, the server ignores any that it had in fact received.
+type Outbox struct {
+	pending []*messages.Message
+	// retries counts how many times each pending message has been refused
+	// for a reason that may pass
+	retries map[string]int
+	sync.Mutex
+}
+
+func NewOutbox() *Outbox {
+	return &Outbox{retries: make(map[string]int)}
+}
+
+// Add holds msg until the server responds to it. Its ID is assigned if it
+// does not have one, so that the server's response can be recognized.
+func (o *Outbox) Add(msg *messages.Message) {
+	if msg.UUID == "" {
+		msg.AssignHashID()
+	}
+	o.Lock()
+	defer o.Unlock()
+	o.pending = append(o.pending, msg)
+}
+
+// Remove discards the message with the given id, to which the server has
+// responded. Removing a message that is not held has no effect.
+func (o *Outbox) Remove(id string) {
+	o.Lock()
+	defer o.Unlock()
+	delete(o.retries, id)
+	for i, msg := range o.pending {
+		if msg.UUID == id {
+			o.pending = append(o.pending[:i], o.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// Get returns the held message with the given id, or nil if it is not held.
+func (o *Outbox) Get(id string) *messages.Message {
+	o.Lock()
+	defer o.Unlock()
+	for _, msg := range o.pending {
+		if msg.UUID == id {
+			return msg
+		}
+	}
+	return nil
+}
+
+// Refused records that the server refused the message with the given id,
+// and returns whether it should be held to be sent again, along with how long
+// to wait before doing so. Messages refused for reasons that will not pass,
+// such as failing validation, are discarded. The wait doubles each time that
+// a message is refused.
+func (o *Outbox) Refused(id string, code messages.ErrorCode) (bool, time.Duration) {
+	switch code {
+	case messages.ERR_INTERNAL, messages.ERR_RATE_LIMITED, messages.ERR_READ_ONLY:
+	default:
+		o.Remove(id)
+		return false, 0
+	}
+	o.Lock()
+	defer o.Unlock()
+	wait := MinBackoff << uint(o.retries[id])
+	if wait > MaxBackoff || wait <= 0 {
+		wait = MaxBackoff
+	} else {
+		o.retries[id]++
+	}
+	return true, wait
+}
+
+// Pending returns the messages held, oldest first.
+func (o *Outbox) Pending() []*messages.Message {
+	o.Lock()
+	defer o.Unlock()
+	pending := make([]*messages.Message, len(o.pending))
+	copy(pending, o.pending)
+	return pending
+}
+
+// Len returns the number of messages held.
+func (o *Outbox) Len() int {
+	o.Lock()
+	defer o.Unlock()
+	return len(o.pending)
+}
+
+// post sends msg to the server as a new message. Its ID is used as the
+// request ID, so that an ERROR refusing it can be matched to it.
+func post(requester *messages.Requester, msg *messages.Message) {
+	requester.Send(&messages.ArborMessage{
+		Type:      messages.NEW_MESSAGE,
+		RequestID: msg.UUID,
+		Message:   msg,
+	})
+}
@@ -0,0 +1,97 @@
+package clientio
+
+import (
+	"log"
+	"sync"
+
+	messages "github.com/whereswaldon/arbor/lib/messages"
+)
+
+// ResumeBatchSize is the number of missed messages requested at once by
+// Resume.
+const ResumeBatchSize = 256
+
+// Position records how far the client has read through the messages of the
+// room that it is in, as the sequence number of the newest one that it has
+// received. It stays at zero with servers that do not number their messages.
+type Position struct {
+	room string
+	seq  uint64
+	sync.Mutex
+}
+
+func NewPosition() *Position {
+	return &Position{}
+}
+
+// Enter records that the client has joined room, whose newest message has
+// sequence number seq.
+func (p *Position) Enter(room string, seq uint64) {
+	p.Lock()
+	defer p.Unlock()
+	p.room = room
+	p.seq = seq
+}
+
+// Advance records that the client has received the message with sequence
+// number seq in room, which the server broadcast after the one numbered prev.
+// If the client has not received that one, it returns the sequence number
+// to resume from in order to fetch the messages that it missed, and
+// otherwise zero. Messages from other rooms, which may still arrive just
+// after leaving them, are ignored.
+func (p *Position) Advance(room string, seq, prev uint64) uint64 {
+	p.Lock()
+	defer p.Unlock()
+	if room != p.room || seq <= p.seq {
+		return 0
+	}
+	from := p.seq
+	p.seq = seq
+	if prev > from {
+		return from
+	}
+	return 0
+}
+
+// Get returns the client's room and the sequence number of the newest message
+// that it has received there.
+func (p *Position) Get() (string, uint64) {
+	p.Lock()
+	defer p.Unlock()
+	return p.room, p.seq
+}
+
+// Resume asks the server for every message in room that is newer than the one
+// with sequence number seq, which HandleNewMessages then delivers like any
+// other new message. It returns once the server has sent them all, or the
+// connection is lost. It does nothing if the server does not number its
+// messages.
+func Resume(codec *messages.Codec, requester *messages.Requester, room string, seq uint64) {
+	if seq == 0 || !codec.Version().Supports(messages.RESUME) {
+		return
+	}
+	for {
+		received := 0
+		var done *messages.ArborMessage
+		for response := range requester.Request(&messages.ArborMessage{
+			Type:  messages.RESUME,
+			Room:  room,
+			Seq:   seq,
+			Limit: ResumeBatchSize,
+		}) {
+			switch response.Type {
+			case messages.NEW_MESSAGE:
+				received++
+			case messages.DONE:
+				done = response
+			case messages.ERROR:
+				log.Println("Unable to resume from message", seq, response.Reason)
+			}
+		}
+		if done == nil || received < ResumeBatchSize {
+			return
+		}
+		// the server stopped at the limit, so there may be more
+		seq = done.Seq
+	}
+}
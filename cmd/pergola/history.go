@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/ed25519"
 	"fmt"
 	"io"
 	"log"
@@ -9,17 +10,42 @@ import (
 
 	"github.com/jroimartin/gocui"
 	wrap "github.com/mitchellh/go-wordwrap"
+	"github.com/whereswaldon/arbor/cmd/pergola/clientio"
 	vs "github.com/whereswaldon/arbor/cmd/pergola/view_state"
 	"github.com/whereswaldon/arbor/lib/messages"
 )
 
 const ReplyView = "reply-view"
+const ErrorView = "error-view"
+const RoomView = "room-view"
+const StatusView = "status-view"
+
+// ErrorDisplayTime is how long an error from the server stays on screen.
+const ErrorDisplayTime = 10 * time.Second
 
 type History struct {
 	vs.ThreadView
 	ViewIDs  map[string]struct{}
 	Query    chan<- string
 	Outbound chan<- *messages.Message
+	// ErrorText is the most recent error reported by the server. It should
+	// only be modified from within the UI's event loop, using ShowError.
+	ErrorText string
+	// errorsShown counts the errors shown, so that each one is only cleared
+	// if no other has replaced it
+	errorsShown int
+	// SigningKey, if set, is used to sign every message that is sent.
+	SigningKey ed25519.PrivateKey
+	// Room is the name of the room being viewed, and Rooms lists every room
+	// on the server. They should only be modified from within the UI's event
+	// loop.
+	Room  string
+	Rooms []string
+	// RoomChanges receives a request whenever the user switches rooms.
+	RoomChanges chan<- clientio.RoomChange
+	// Connection describes the state of the connection to the server. It
+	// should only be modified from within the UI's event loop.
+	Connection clientio.ConnectionState
 }
 
 // NewList creates a new History that uses the provided Tree
@@ -66,6 +92,9 @@ func (m *History) Layout(ui *gocui.Gui) error {
 	cursorX := 0
 	cursorId := m.Cursor()
 	if cursorId == "" {
+		// nothing has arrived yet, but the state of the connection still
+		// needs to be shown
+		m.drawBanners(maxX, maxY, ui)
 		return nil
 	}
 	err, cursorHeight := m.drawView(cursorX, cursorY, maxX-1, down, true, cursorId, ui) //draw the cursor message
@@ -90,7 +119,13 @@ func (m *History) Layout(ui *gocui.Gui) error {
 	}
 	upperBound := cursorY - 1
 	for currentIdxAbove++; currentIdxAbove < len(thread) && upperBound >= 0; currentIdxAbove++ {
-		err, msgHeight := m.drawView(0, upperBound, maxX-1, up, false, thread[currentIdxAbove].UUID, ui) //draw the cursor message
+		item := thread[currentIdxAbove]
+		var msgHeight int
+		if m.ThreadView.Get(item.UUID) == nil {
+			err, msgHeight = m.drawPlaceholder(0, upperBound, maxX-1, item, ui)
+		} else {
+			err, msgHeight = m.drawView(0, upperBound, maxX-1, up, false, item.UUID, ui)
+		}
 		if err != nil {
 			log.Println("error drawing view: ", err)
 			return err
@@ -100,9 +135,24 @@ func (m *History) Layout(ui *gocui.Gui) error {
 	if m.IsReplying() {
 		m.drawReplyView(0, replyY, maxX-1, 5, ui)
 	}
+	m.drawBanners(maxX, maxY, ui)
 	return nil
 }
 
+// drawBanners draws the error, room and status views over the messages in a
+// UI of the given size.
+func (m *History) drawBanners(maxX, maxY int, ui *gocui.Gui) {
+	if m.ErrorText != "" {
+		m.drawErrorView(0, maxY-3, maxX-1, ui)
+	}
+	statusY := 0
+	if len(m.Rooms) > 1 {
+		m.drawRoomView(0, 0, maxX-1, ui)
+		statusY += 3
+	}
+	m.drawStatusView(0, statusY, maxX-1, ui)
+}
+
 type Direction int
 
 const up Direction = 0
@@ -150,7 +200,7 @@ func (h *History) drawView(x, y, w int, dir Direction, isCursor bool, id string,
 			log.Println(err)
 			return err, 0
 		}
-		v.Title = id
+		v.Title = signatureBadge(msg) + " " + id
 		v.Wrap = true
 		fmt.Fprint(v, contents)
 		if isCursor {
@@ -168,6 +218,38 @@ func (h *History) drawView(x, y, w int, dir Direction, isCursor bool, id string,
 	return nil, height + 1
 }
 
+// signatureBadge describes whether the author of msg can be trusted.
+func signatureBadge(msg *messages.Message) string {
+	switch status := msg.VerifySignature(); status {
+	case messages.Verified:
+		return fmt.Sprintf("[%s %s %s]", msg.Username, status, messages.KeyFingerprint(msg.PublicKey))
+	case messages.Invalid:
+		return fmt.Sprintf("[%s SIGNATURE INVALID]", msg.Username)
+	default:
+		return fmt.Sprintf("[%s %s]", msg.Username, status)
+	}
+}
+
+// drawPlaceholder draws a stand-in for an ancestor message that has not yet
+// been received, with its lower edge at y.
+func (h *History) drawPlaceholder(x, y, w int, placeholder *messages.Message, ui *gocui.Gui) (error, int) {
+	const height = 2
+	const gutterWidth = 4
+	name := fmt.Sprintf("placeholder-%d", placeholder.Depth)
+	if v, err := ui.SetView(name, x+gutterWidth, y-height, x+w, y); err != nil {
+		if err != gocui.ErrUnknownView {
+			log.Println(err)
+			return err, 0
+		}
+		if placeholder.UUID != "" {
+			v.Title = placeholder.UUID
+		}
+		fmt.Fprintf(v, "(loading message at depth %d)", placeholder.Depth)
+		h.ViewIDs[name] = struct{}{}
+	}
+	return nil, height + 1
+}
+
 func (his *History) drawReplyView(x, y, w, h int, ui *gocui.Gui) error {
 	if v, err := ui.SetView(ReplyView, x, y, x+w, y+h); err != nil {
 		if err != gocui.ErrUnknownView {
@@ -184,6 +266,93 @@ func (his *History) drawReplyView(x, y, w, h int, ui *gocui.Gui) error {
 	return nil
 }
 
+// ShowError displays reason until ErrorDisplayTime has passed. It should only
+// be called from within the UI's event loop.
+func (m *History) ShowError(ui *gocui.Gui, reason string) {
+	m.ErrorText = reason
+	m.errorsShown++
+	shown := m.errorsShown
+	time.AfterFunc(ErrorDisplayTime, func() {
+		ui.Update(func(*gocui.Gui) error {
+			if m.errorsShown == shown {
+				m.ErrorText = ""
+			}
+			return nil
+		})
+	})
+}
+
+func (his *History) drawErrorView(x, y, w int, ui *gocui.Gui) error {
+	if v, err := ui.SetView(ErrorView, x, y, x+w, y+2); err != nil {
+		if err != gocui.ErrUnknownView {
+			log.Println(err)
+			return err
+		}
+		v.Title = "Error"
+		v.FgColor = gocui.ColorRed
+		fmt.Fprint(v, his.ErrorText)
+		his.ViewIDs[ErrorView] = struct{}{}
+	}
+	ui.SetViewOnTop(ErrorView)
+	return nil
+}
+
+func (his *History) drawRoomView(x, y, w int, ui *gocui.Gui) error {
+	if v, err := ui.SetView(RoomView, x, y, x+w, y+2); err != nil {
+		if err != gocui.ErrUnknownView {
+			log.Println(err)
+			return err
+		}
+		v.Title = "Room"
+		fmt.Fprintf(v, "%s (Tab to switch, %d rooms)", his.Room, len(his.Rooms))
+		his.ViewIDs[RoomView] = struct{}{}
+	}
+	ui.SetViewOnTop(RoomView)
+	return nil
+}
+
+func (his *History) drawStatusView(x, y, w int, ui *gocui.Gui) error {
+	if v, err := ui.SetView(StatusView, x, y, x+w, y+2); err != nil {
+		if err != gocui.ErrUnknownView {
+			log.Println(err)
+			return err
+		}
+		v.Title = "Connection"
+		state := his.Connection
+		switch state.Status {
+		case clientio.Connected:
+			v.FgColor = gocui.ColorGreen
+			fmt.Fprint(v, "Connected")
+		case clientio.Stale:
+			v.FgColor = gocui.ColorYellow
+			fmt.Fprintf(v, "Stale: nothing heard from the server since %s", state.LastHeard.Format("15:04:05"))
+		case clientio.Offline:
+			v.FgColor = gocui.ColorRed
+			fmt.Fprintf(v, "Offline: reconnecting at %s", state.RetryAt.Format("15:04:05"))
+		default:
+			v.FgColor = gocui.ColorYellow
+			fmt.Fprintf(v, "%s to the server", state.Status)
+		}
+		if state.Queued > 0 && state.Status != clientio.Connected {
+			fmt.Fprintf(v, " (%d messages waiting to be sent)", state.Queued)
+		}
+		his.ViewIDs[StatusView] = struct{}{}
+	}
+	ui.SetViewOnTop(StatusView)
+	return nil
+}
+
+// NextRoom asks to switch to the room following the current one.
+func (m *History) NextRoom(g *gocui.Gui, v *gocui.View) error {
+	if m.IsReplying() || len(m.Rooms) < 2 || m.RoomChanges == nil {
+		return nil
+	}
+	next := m.Rooms[(indexOf(m.Room, m.Rooms)+1)%len(m.Rooms)]
+	log.Println("Switching from room", m.Room, "to", next)
+	m.RoomChanges <- clientio.RoomChange{Leave: m.Room, Join: next}
+	return nil
+}
+
 func (m *History) BeginReply(g *gocui.Gui, v *gocui.View) error {
 	m.ReplyTo(m.Cursor())
 	return nil
@@ -209,6 +378,9 @@ func (m *History) SendReply(g *gocui.Gui, v *gocui.View) error {
 		Parent:  id,
 		Content: string(data[:n]),
 	}
+	if m.SigningKey != nil {
+		msg.Sign(m.SigningKey)
+	}
 	log.Printf("Sending reply to %s: %s\n", id, string(data))
 	m.Outbound <- msg
 	return nil
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// loadSigningKey reads a hex-encoded ed25519 private key seed from the file at
+// path. If there is no such file, a new key is generated and saved there.
+func loadSigningKey(path string) (ed25519.PrivateKey, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to generate signing key")
+		}
+		encoded := hex.EncodeToString(key.Seed()) + "\n"
+		if err := ioutil.WriteFile(path, []byte(encoded), 0600); err != nil {
+			return nil, errors.Wrapf(err, "Unable to save signing key")
+		}
+		return key, nil
+	} else if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read signing key")
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to decode signing key")
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, errors.Errorf("Signing key in %s has %d bytes, expected %d", path, len(seed), ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
@@ -1,14 +1,16 @@
 package main
 
 import (
+	"flag"
+	"io"
 	"log"
-	"net"
 	"os"
 
 	"github.com/jroimartin/gocui"
 	"github.com/pkg/profile"
 	"github.com/whereswaldon/arbor/cmd/pergola/clientio"
 	"github.com/whereswaldon/arbor/lib/messages"
+	"github.com/whereswaldon/arbor/lib/transport"
 )
 
 func quit(g *gocui.Gui, v *gocui.View) error {
@@ -17,8 +19,17 @@ func quit(g *gocui.Gui, v *gocui.View) error {
 
 func main() {
 	defer profile.Start().Stop()
-	if len(os.Args) < 2 {
-		log.Println("Usage: " + os.Args[0] + " <host:port>")
+	framingName := flag.String("framing", messages.NewlineFraming.String(), "message framing used by the server (newline or length)")
+	keyPath := flag.String("key", "", "file holding the key used to sign messages, created if missing (messages are unsigned if empty)")
+	tlsConfig := transport.AddClientFlags(flag.CommandLine)
+	flag.Parse()
+	if flag.NArg() < 1 {
+		log.Println("Usage: " + os.Args[0] + " [flags] <host:port>")
+		return
+	}
+	framing, err := messages.ParseFraming(*framingName)
+	if err != nil {
+		log.Println(err)
 		return
 	}
 	ui, err := gocui.NewGui(gocui.OutputNormal)
@@ -28,20 +39,39 @@ func main() {
 	}
 	defer ui.Close()
 
-	layoutManager, queries, outbound := NewList(NewTree(messages.NewStore()))
+	tree := NewTree(messages.NewStore())
+	layoutManager, queries, outbound := NewList(tree)
+	if *keyPath != "" {
+		key, err := loadSigningKey(*keyPath)
+		if err != nil {
+			log.Println(err)
+			return
+		}
+		layoutManager.SigningKey = key
+	}
 	msgs := make(chan *messages.Message)
 	ui.Highlight = true
 	ui.Cursor = true
 	ui.SelFgColor = gocui.ColorGreen
 	ui.SetManager(layoutManager)
 
-	conn, err := net.Dial("tcp", os.Args[1])
-	if err != nil {
-		log.Println("Unable to connect", err)
-		return
-	}
 	welcomes := make(chan *messages.ArborMessage)
-	go clientio.HandleNewMessages(conn, msgs, welcomes)
+	errs := make(chan *messages.ArborMessage)
+	states := make(chan clientio.ConnectionState)
+	dial := func() (io.ReadWriteCloser, error) {
+		return transport.Dial(flag.Arg(0), tlsConfig)
+	}
+	connection := clientio.NewConnection(dial, framing, msgs, welcomes, errs, states)
+	go connection.Run()
+	go func() {
+		for state := range states {
+			state := state
+			ui.Update(func(*gocui.Gui) error {
+				layoutManager.Connection = state
+				return nil
+			})
+		}
+	}()
 	go func() {
 		for newMsg := range msgs {
 			layoutManager.Add(newMsg)
@@ -52,9 +82,42 @@ func main() {
 	}()
 
 	go func() {
+		for e := range errs {
+			log.Println("Error from server:", e.String())
+			if e.Code == messages.ERR_UNKNOWN_ID && e.Message != nil {
+				tree.MarkUnavailable(e.Message.UUID)
+			}
+			reason := e.Reason
+			ui.Update(func(g *gocui.Gui) error {
+				layoutManager.ShowError(g, reason)
+				return nil
+			})
+		}
+	}()
+
+	roomChanges := make(chan clientio.RoomChange)
+	layoutManager.RoomChanges = roomChanges
+	go func() {
+		// the room whose messages are being shown
+		currentRoom := ""
 		for message := range welcomes {
 			rootID := message.Root
 			recents := message.Recent
+			if currentRoom != "" && message.Room != currentRoom {
+				// start over with the new room's messages, but keep
+				// everything when returning to the same room after
+				// reconnecting
+				layoutManager.Reset()
+			}
+			currentRoom = message.Room
+			room, rooms := message.Room, message.Rooms
+			ui.Update(func(*gocui.Gui) error {
+				layoutManager.Room = room
+				if rooms != nil {
+					layoutManager.Rooms = rooms
+				}
+				return nil
+			})
 			queries <- rootID
 			for _, recentID := range recents {
 				if recentID != "" {
@@ -64,7 +127,7 @@ func main() {
 
 		}
 	}()
-	go clientio.HandleRequests(conn, queries, outbound)
+	go connection.HandleRequests(queries, outbound, roomChanges)
 
 	type keybinding struct {
 		viewId  string
@@ -86,6 +149,7 @@ func main() {
 			{"", 'l', gocui.ModNone, layoutManager.CursorRight},
 		*/
 		{"", gocui.KeyEnter, gocui.ModNone, layoutManager.BeginReply},
+		{"", gocui.KeyTab, gocui.ModNone, layoutManager.NextRoom},
 	}
 
 	for _, binding := range bindings {
@@ -8,19 +8,23 @@ import (
 )
 
 type Tree struct {
-	*messages.Store
+	messages.Store
 	sync.RWMutex
 	// ChildrenMap is a map from a message's UUID to a slide of UUIDs for each
 	// child message of that message
 	ChildrenMap map[string][]string
 	SeenSet     map[string]struct{}
+	// UnavailableSet contains the UUIDs of messages that the server was
+	// unable to provide
+	UnavailableSet map[string]struct{}
 }
 
-func NewTree(s *messages.Store) *Tree {
+func NewTree(s messages.Store) *Tree {
 	return &Tree{
-		Store:       s,
-		ChildrenMap: make(map[string][]string),
-		SeenSet:     make(map[string]struct{}),
+		Store:          s,
+		ChildrenMap:    make(map[string][]string),
+		SeenSet:        make(map[string]struct{}),
+		UnavailableSet: make(map[string]struct{}),
 	}
 }
 
@@ -37,6 +41,21 @@ func (t *Tree) MarkSeen(messageId string) {
 	t.Unlock()
 }
 
+// MarkUnavailable records that the message with the given id cannot be fetched,
+// so that it will no longer be requested by GetItems.
+func (t *Tree) MarkUnavailable(messageId string) {
+	t.Lock()
+	t.UnavailableSet[messageId] = struct{}{}
+	t.Unlock()
+}
+
+func (t *Tree) unavailable(messageId string) bool {
+	t.RLock()
+	_, found := t.UnavailableSet[messageId]
+	t.RUnlock()
+	return found
+}
+
 // Add stores the message and its relationship with its parent within the message
 // tree.
 func (t *Tree) Add(msg *messages.Message) {
@@ -88,8 +107,13 @@ func (t *Tree) Leaf(id string) string {
 // getItems returns a slice of messages starting from the current
 // leaf message id and working backward along its ancestry. It will never return
 // more than maxLength messages in the slice. If it encounters a message ID that is
-// unknown, it will return that in the query value. Otherwise, query will return the
-// empty string.
+// unknown, it will return that in the query value unless the server has already
+// reported that it is unavailable. Otherwise, query will return the empty string.
+//
+// When an unknown ancestor is encountered, the Depth of its known descendant is used
+// to fill the rest of the slice with placeholders for each of the missing ancestors.
+// Placeholders are not present in the Tree and have only their Depth set, with the
+// exception of the first, which also has the UUID of the unknown ancestor.
 func (t *Tree) GetItems(leafId string, maxLength int) (items []*messages.Message, query string) {
 	items = make([]*messages.Message, maxLength)
 	current := t.Get(leafId)
@@ -104,12 +128,23 @@ func (t *Tree) GetItems(leafId string, maxLength int) (items []*messages.Message
 			break
 		}
 		parent = current.Parent
-		current = t.Get(current.Parent)
-		if current == nil {
+		next := t.Get(current.Parent)
+		if next == nil {
 			//request the message corresponding to parentID
-			query = parent
+			if !t.unavailable(parent) {
+				query = parent
+			}
+			for depth := current.Depth; depth > 0 && count < len(items); depth-- {
+				placeholder := &messages.Message{Depth: depth - 1}
+				if depth == current.Depth {
+					placeholder.UUID = parent
+				}
+				items[count] = placeholder
+				count++
+			}
 			break
 		}
+		current = next
 		count++
 	}
 	return items[:min(count, len(items))], query
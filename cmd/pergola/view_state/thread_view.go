@@ -59,6 +59,18 @@ func (t *ThreadView) ClearReply() {
 	t.Unlock()
 }
 
+// Reset forgets the current thread, leaf, cursor, and reply so that the view
+// can begin again with a different conversation. The next message passed to
+// UpdateLeaf becomes both the leaf and the cursor.
+func (t *ThreadView) Reset() {
+	t.Lock()
+	t.Thread = nil
+	t.LeafID = ""
+	t.CursorID = ""
+	t.ReplyToId = ""
+	t.Unlock()
+}
+
 // UpdateLeaf sets the provided UUID as the ID of the current "leaf"
 // message within the view of the conversation *if* it is a child of
 // the previous current "leaf" message. If there is no cursor, the new
@@ -8,6 +8,56 @@ const (
 	WELCOME     = 0
 	QUERY       = 1
 	NEW_MESSAGE = 2
+	VERSION     = 3
+	ERROR       = 4
+	ANCESTRY    = 5
+	CHILDREN    = 6
+	SUBTREE     = 7
+	DONE        = 8
+	SHUTDOWN    = 9
+	JOIN        = 10
+	LEAVE       = 11
+	LIST_ROOMS  = 12
+	PING        = 13
+	PONG        = 14
+	SYNC        = 15
+	REPLICATE   = 16
+	RESUME      = 17
+	PEER        = 18
+)
+
+// ErrorCode identifies the kind of problem described by an ERROR message.
+type ErrorCode uint16
+
+const (
+	// ERR_INTERNAL means that the server failed for reasons unrelated to the request.
+	ERR_INTERNAL ErrorCode = 1
+	// ERR_UNKNOWN_ID means that a message ID in the request does not exist.
+	ERR_UNKNOWN_ID ErrorCode = 2
+	// ERR_MALFORMED means that the request could not be decoded.
+	ERR_MALFORMED ErrorCode = 3
+	// ERR_TOO_LARGE means that the request exceeded MaxMessageSize.
+	ERR_TOO_LARGE ErrorCode = 4
+	// ERR_UNKNOWN_TYPE means that the request's Type is not recognized.
+	ERR_UNKNOWN_TYPE ErrorCode = 5
+	// ERR_INVALID_METADATA means that a message's metadata is invalid or too large.
+	ERR_INVALID_METADATA ErrorCode = 6
+	// ERR_INVALID_SIGNATURE means that a message's signature does not match it.
+	ERR_INVALID_SIGNATURE ErrorCode = 7
+	// ERR_UNKNOWN_ROOM means that the requested room does not exist.
+	ERR_UNKNOWN_ROOM ErrorCode = 8
+	// ERR_UNKNOWN_PARENT means that a new message does not reply to a known message.
+	ERR_UNKNOWN_PARENT ErrorCode = 9
+	// ERR_INVALID_FIELD means that a field of a new message is missing, too long, or not permitted.
+	ERR_INVALID_FIELD ErrorCode = 10
+	// ERR_INVALID_TIMESTAMP means that a new message's timestamp is too far from the server's clock.
+	ERR_INVALID_TIMESTAMP ErrorCode = 11
+	// ERR_RATE_LIMITED means that the client has sent too many requests too quickly.
+	ERR_RATE_LIMITED ErrorCode = 12
+	// ERR_READ_ONLY means that the server is a follower, which does not accept new messages.
+	ERR_READ_ONLY ErrorCode = 13
+	// ERR_NOT_PERMITTED means that the client is not permitted to make the request.
+	ERR_NOT_PERMITTED ErrorCode = 14
 )
 
 type ArborMessage struct {
@@ -16,9 +66,88 @@ type ArborMessage struct {
 	Recent []string
 	Major  uint8
 	Minor  uint8
+	// Versions lists the protocol versions a client is able to speak. It
+	// is only set on VERSION messages sent by clients.
+	Versions []Version `json:",omitempty"`
+	// Reason explains why a request was refused.
+	Reason string `json:",omitempty"`
+	// Code identifies the problem described by an ERROR message.
+	Code ErrorCode `json:",omitempty"`
+	// RequestID is an optional identifier chosen by a client for a request.
+	// The server copies it into every response to that request, including
+	// errors. Broadcasts of new messages never carry a RequestID.
+	RequestID string `json:",omitempty"`
+	// Limit bounds the size of the response to an ANCESTRY or SUBTREE query.
+	Limit uint32 `json:",omitempty"`
+	// Room names the room that a WELCOME, JOIN, or LEAVE message concerns,
+	// or the room in which a broadcast NEW_MESSAGE was posted.
+	Room string `json:",omitempty"`
+	// Rooms lists the names of the server's rooms in WELCOME and LIST_ROOMS
+	// messages.
+	Rooms []string `json:",omitempty"`
+	// Via lists the IDs of the servers that have relayed a NEW_MESSAGE to
+	// another server, in the order that they did so.
+	Via []string `json:",omitempty"`
+	// Digest summarizes the subtree beneath the message in a SYNC response,
+	// and Digests maps the IDs of some of its replies to the Digests of their
+	// subtrees.
+	Digest  string            `json:",omitempty"`
+	Digests map[string]string `json:",omitempty"`
+	// Seq is the position of a message in the order in which the server
+	// accepted them. Broadcast NEW_MESSAGEs carry their own Seq, while
+	// WELCOME and JOIN messages carry that of the newest message, and
+	// RESUME and REPLICATE requests the last one that the client has.
+	Seq uint64 `json:",omitempty"`
+	// Prev is the Seq of the message broadcast before a NEW_MESSAGE in the
+	// same room, so that clients can tell whether they have missed any.
+	Prev uint64 `json:",omitempty"`
+	// Token is the secret shared by the servers that relay to or replicate
+	// from each other, which a server sends in a PEER request.
+	Token string `json:",omitempty"`
 	*Message
 }
 
+// RelayedBy returns whether the server with the given ID has relayed m.
+func (m *ArborMessage) RelayedBy(serverID string) bool {
+	for _, id := range m.Via {
+		if id == serverID {
+			return true
+		}
+	}
+	return false
+}
+
+// NewError creates an ERROR message. If the error concerns a particular
+// message, its ID should be provided as id.
+func NewError(code ErrorCode, reason, id string) *ArborMessage {
+	a := &ArborMessage{
+		Type:   ERROR,
+		Code:   code,
+		Reason: reason,
+	}
+	if id != "" {
+		a.Message = &Message{UUID: id}
+	}
+	return a
+}
+
+// Version returns the protocol version described by the Major and Minor fields
+func (m *ArborMessage) Version() Version {
+	return Version{Major: m.Major, Minor: m.Minor}
+}
+
+// IsVersionRejection returns whether m is a VERSION message refusing to
+// communicate using any of the versions that were offered.
+func (m *ArborMessage) IsVersionRejection() bool {
+	return m.Type == VERSION && m.Reason != ""
+}
+
+// IsVersionChoice returns whether m is a VERSION message announcing the
+// protocol version that a server has chosen for the connection.
+func (m *ArborMessage) IsVersionChoice() bool {
+	return m.Type == VERSION && m.Reason == "" && len(m.Versions) == 0
+}
+
 func (m *ArborMessage) String() string {
 
 	data, _ := json.Marshal(m)
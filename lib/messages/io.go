@@ -1,41 +1,317 @@
 package messages
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"sync"
 )
 
-func MakeMessageWriter(conn io.ReadWriteCloser) chan<- *ArborMessage {
+// MaxMessageSize is the largest number of bytes that the JSON encoding of
+// a single Arbor message may occupy on the wire.
+const MaxMessageSize = 65536
+
+// lengthHeaderSize is the number of bytes in the header that precedes each
+// message when using LengthFraming.
+const lengthHeaderSize = 4
+
+// Framing describes how the boundaries between protocol messages are
+// marked on the wire.
+type Framing uint8
+
+const (
+	// NewlineFraming terminates each JSON message with a newline character.
+	NewlineFraming Framing = 0
+	// LengthFraming precedes each JSON message with its length in bytes,
+	// encoded as a 4-byte big-endian unsigned integer.
+	LengthFraming Framing = 1
+)
+
+// ParseFraming converts the name of a framing mode (as returned by
+// Framing.String) into a Framing.
+func ParseFraming(name string) (Framing, error) {
+	switch name {
+	case "newline":
+		return NewlineFraming, nil
+	case "length":
+		return LengthFraming, nil
+	}
+	return NewlineFraming, fmt.Errorf("Unknown framing %q", name)
+}
+
+func (f Framing) String() string {
+	switch f {
+	case NewlineFraming:
+		return "newline"
+	case LengthFraming:
+		return "length"
+	}
+	return fmt.Sprintf("Framing(%d)", uint8(f))
+}
+
+// Codec reads and writes the messages exchanged over a single connection.
+// It starts out speaking protocol version 0.1 and adopts a new version
+// whenever a VERSION message announcing a choice of version passes through
+// its reader or writer. Messages whose types do not exist in the current
+// version are dropped rather than sent or delivered.
+type Codec struct {
+	Framing Framing
+	// OnReadError, if set, is called with an ERROR message describing any
+	// data from the peer that could not be decoded, or that has a type
+	// unknown to the current protocol version.
+	OnReadError func(*ArborMessage)
+	sync.RWMutex
+	version Version
+}
+
+// NewCodec creates a Codec that uses the provided framing.
+func NewCodec(framing Framing) *Codec {
+	return &Codec{
+		Framing: framing,
+		version: Version0_1,
+	}
+}
+
+// Version returns the protocol version currently in use.
+func (c *Codec) Version() Version {
+	c.RLock()
+	defer c.RUnlock()
+	return c.version
+}
+
+// SetVersion changes the protocol version currently in use.
+func (c *Codec) SetVersion(v Version) {
+	c.Lock()
+	c.version = v
+	c.Unlock()
+}
+
+// reportReadError passes a description of bad input to OnReadError.
+func (c *Codec) reportReadError(code ErrorCode, reason string) {
+	if c.OnReadError != nil {
+		c.OnReadError(NewError(code, reason, ""))
+	}
+}
+
+// observe updates the codec's state in response to a message that was sent
+// or received, and returns whether that message is valid in the current
+// protocol version.
+func (c *Codec) observe(message *ArborMessage) bool {
+	if message.IsVersionChoice() {
+		if _, ok := Negotiate([]Version{message.Version()}); ok {
+			log.Println("Using protocol version", message.Version())
+			c.SetVersion(message.Version())
+		}
+	}
+	if version := c.Version(); !version.Supports(message.Type) {
+		log.Printf("Message type %d is not part of protocol version %s\n", message.Type, version)
+		return false
+	}
+	return true
+}
+
+// observeRead is observe for messages that were received from the peer.
+func (c *Codec) observeRead(message *ArborMessage) bool {
+	if !c.observe(message) {
+		c.reportReadError(ERR_UNKNOWN_TYPE, fmt.Sprintf("Message type %d is not part of protocol version %s", message.Type, c.Version()))
+		return false
+	}
+	return true
+}
+
+// MakeWriter returns a channel of messages that will be written to conn.
+// The caller should close the channel once it has nothing more to send. If
+// a message cannot be written, conn is closed and any further messages are
+// discarded. Likewise, if a VERSION message refusing the connection is
+// written, conn is closed once it has been sent.
+func (c *Codec) MakeWriter(conn io.ReadWriteCloser) chan<- *ArborMessage {
+	input, _ := c.MakeWriterWithDone(conn)
+	return input
+}
+
+// MakeWriterWithDone is like MakeWriter, but also returns a channel that is
+// closed once the returned message channel has been closed and every message
+// sent on it has been written (or discarded because writing failed).
+func (c *Codec) MakeWriterWithDone(conn io.ReadWriteCloser) (chan<- *ArborMessage, <-chan struct{}) {
 	input := make(chan *ArborMessage)
+	done := make(chan struct{})
 	go func() {
-    		defer close(input)
-		encoder := json.NewEncoder(conn)
-		for message := range input {
-			err := encoder.Encode(message)
-			if err != nil {
-				log.Println("Error encoding message", err)
-				return
-			}
+		defer close(done)
+		var err error
+		switch c.Framing {
+		case LengthFraming:
+			err = c.writeLengthFramed(conn, input)
+		default:
+			err = c.writeNewlineFramed(conn, input)
+		}
+		if err != nil {
+			log.Println("Error encoding message", err)
+			conn.Close()
+		}
+		// keep receiving so that senders are never blocked forever on a
+		// connection that has failed
+		for range input {
 		}
 	}()
-	return input
+	return input, done
 }
 
-func MakeMessageReader(conn io.ReadWriteCloser) <-chan *ArborMessage {
+// MakeReader returns a channel of the messages read from conn. The channel
+// is closed when conn can no longer be read.
+func (c *Codec) MakeReader(conn io.ReadWriteCloser) <-chan *ArborMessage {
 	output := make(chan *ArborMessage)
 	go func() {
 		defer close(output)
-		decoder := json.NewDecoder(conn)
-		for {
-			a := &ArborMessage{}
-			err := decoder.Decode(a)
-			if err != nil {
-				log.Println("Error decoding json:", err)
-				return
-			}
-			output <- a
+		switch c.Framing {
+		case LengthFraming:
+			c.readLengthFramed(conn, output)
+		default:
+			c.readNewlineFramed(conn, output)
 		}
 	}()
 	return output
 }
+
+// MakeMessageWriter returns a channel of messages that will be written to
+// conn as newline-delimited JSON.
+func MakeMessageWriter(conn io.ReadWriteCloser) chan<- *ArborMessage {
+	return MakeFramedMessageWriter(conn, NewlineFraming)
+}
+
+// MakeMessageReader returns a channel of the newline-delimited JSON messages
+// read from conn. The channel is closed when conn can no longer be read.
+func MakeMessageReader(conn io.ReadWriteCloser) <-chan *ArborMessage {
+	return MakeFramedMessageReader(conn, NewlineFraming)
+}
+
+// MakeFramedMessageWriter returns a channel of messages that will be written
+// to conn using the provided framing.
+func MakeFramedMessageWriter(conn io.ReadWriteCloser, framing Framing) chan<- *ArborMessage {
+	return NewCodec(framing).MakeWriter(conn)
+}
+
+// MakeFramedMessageReader returns a channel of the messages read from conn
+// using the provided framing. The channel is closed when conn can no longer
+// be read.
+func MakeFramedMessageReader(conn io.ReadWriteCloser, framing Framing) <-chan *ArborMessage {
+	return NewCodec(framing).MakeReader(conn)
+}
+
+func (c *Codec) writeNewlineFramed(conn io.WriteCloser, input <-chan *ArborMessage) error {
+	for message := range input {
+		if !c.observe(message) {
+			continue
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		// the limit includes the newline
+		if len(data) >= MaxMessageSize {
+			log.Printf("Refusing to send %d byte message, limit is %d\n", len(data)+1, MaxMessageSize)
+			continue
+		}
+		if _, err := conn.Write(append(data, '\n')); err != nil {
+			return err
+		}
+		if message.IsVersionRejection() {
+			return conn.Close()
+		}
+	}
+	return nil
+}
+
+func (c *Codec) writeLengthFramed(conn io.WriteCloser, input <-chan *ArborMessage) error {
+	frame := &bytes.Buffer{}
+	for message := range input {
+		if !c.observe(message) {
+			continue
+		}
+		data, err := json.Marshal(message)
+		if err != nil {
+			return err
+		}
+		if len(data) > MaxMessageSize {
+			log.Printf("Refusing to send %d byte message, limit is %d\n", len(data), MaxMessageSize)
+			continue
+		}
+		frame.Reset()
+		binary.Write(frame, binary.BigEndian, uint32(len(data)))
+		frame.Write(data)
+		// write header and body together so that concurrent writers to the
+		// same connection cannot interleave them
+		if _, err := conn.Write(frame.Bytes()); err != nil {
+			return err
+		}
+		if message.IsVersionRejection() {
+			return conn.Close()
+		}
+	}
+	return nil
+}
+
+func (c *Codec) readNewlineFramed(conn io.Reader, output chan<- *ArborMessage) {
+	// a line that does not fit in the buffer, including its newline, is
+	// longer than any message may be
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 4096), MaxMessageSize)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+		a := &ArborMessage{}
+		if err := json.Unmarshal(line, a); err != nil {
+			// the line boundaries are still known, so skip to the next one
+			log.Println("Error decoding json:", err)
+			c.reportReadError(ERR_MALFORMED, "Unable to decode message: "+err.Error())
+			continue
+		}
+		if c.observeRead(a) {
+			output <- a
+		}
+	}
+	if err := scanner.Err(); err == bufio.ErrTooLong {
+		log.Printf("Message exceeds limit of %d bytes\n", MaxMessageSize)
+		c.reportReadError(ERR_TOO_LARGE, fmt.Sprintf("Message exceeds limit of %d bytes", MaxMessageSize))
+	} else if err != nil {
+		log.Println("Error reading message:", err)
+	}
+}
+
+func (c *Codec) readLengthFramed(conn io.Reader, output chan<- *ArborMessage) {
+	// conn is read directly rather than through a buffer so that nothing
+	// beyond the header is consumed until the length has been checked
+	header := make([]byte, lengthHeaderSize)
+	for {
+		if _, err := io.ReadFull(conn, header); err != nil {
+			log.Println("Error reading frame header:", err)
+			return
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > MaxMessageSize {
+			log.Printf("Frame of %d bytes exceeds limit of %d\n", size, MaxMessageSize)
+			c.reportReadError(ERR_TOO_LARGE, fmt.Sprintf("Frame of %d bytes exceeds limit of %d", size, MaxMessageSize))
+			return
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(conn, body); err != nil {
+			log.Println("Error reading frame body:", err)
+			return
+		}
+		a := &ArborMessage{}
+		if err := json.Unmarshal(body, a); err != nil {
+			// the frame boundaries are still known, so skip to the next one
+			log.Println("Error decoding json:", err)
+			c.reportReadError(ERR_MALFORMED, "Unable to decode message: "+err.Error())
+			continue
+		}
+		if c.observeRead(a) {
+			output <- a
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package messages
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// LogStore is a PersistentStore that appends each message to a file as a
+// line of JSON. An index of where each message begins within the file is
+// kept in memory, so the file is only read when a message is requested.
+type LogStore struct {
+	file   *os.File
+	index  map[string]logEntry
+	order  []string
+	end    int64
+	closed bool
+	sync.RWMutex
+}
+
+// logEntry records the location of a message within the log file.
+type logEntry struct {
+	offset int64
+	length int64
+}
+
+// OpenLogStore opens the log file at path, creating it if it does not exist.
+// If the file ends with a partially-written message, that message is
+// discarded.
+func OpenLogStore(path string) (*LogStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to open message log")
+	}
+	s := &LogStore{
+		file:  file,
+		index: make(map[string]logEntry),
+	}
+	if err := s.load(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// load builds the index from the contents of the log file.
+func (s *LogStore) load() error {
+	reader := bufio.NewReader(s.file)
+	var offset int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("Discarding %d bytes of incomplete message at end of log\n", len(line))
+			}
+			break
+		} else if err != nil {
+			return errors.Wrapf(err, "Unable to read message log")
+		}
+		msg := &Message{}
+		if err := json.Unmarshal(line, msg); err != nil {
+			log.Println("Skipping undecodable message in log at offset", offset, err)
+		} else if err := msg.VerifyID(); err != nil {
+			log.Println("Skipping corrupted message in log:", err)
+		} else if _, exists := s.index[msg.UUID]; !exists {
+			s.index[msg.UUID] = logEntry{offset: offset, length: int64(len(line))}
+			s.order = append(s.order, msg.UUID)
+		}
+		offset += int64(len(line))
+	}
+	// drop any incomplete message so that new ones are appended cleanly
+	if err := s.file.Truncate(offset); err != nil {
+		return errors.Wrapf(err, "Unable to truncate message log")
+	}
+	s.end = offset
+	return nil
+}
+
+// read decodes the message described by entry. The caller must hold the lock.
+func (s *LogStore) read(entry logEntry) (*Message, error) {
+	data := make([]byte, entry.length)
+	if _, err := s.file.ReadAt(data, entry.offset); err != nil {
+		return nil, errors.Wrapf(err, "Unable to read message log")
+	}
+	msg := &Message{}
+	if err := json.Unmarshal(data, msg); err != nil {
+		return nil, errors.Wrapf(err, "Unable to decode message from log")
+	}
+	return msg, nil
+}
+
+func (s *LogStore) Get(uuid string) *Message {
+	s.RLock()
+	defer s.RUnlock()
+	entry, ok := s.index[uuid]
+	if !ok || s.closed {
+		return nil
+	}
+	msg, err := s.read(entry)
+	if err != nil {
+		log.Println(err)
+		return nil
+	}
+	return msg
+}
+
+func (s *LogStore) Add(msg *Message) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to encode message")
+	}
+	// the log relies upon each message occupying exactly one line, which
+	// encoding/json guarantees by escaping newlines within strings
+	data = append(bytes.TrimSpace(data), '\n')
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return errors.New("Message log is closed")
+	}
+	if _, exists := s.index[msg.UUID]; exists {
+		return nil
+	}
+	if _, err := s.file.WriteAt(data, s.end); err != nil {
+		return errors.Wrapf(err, "Unable to write message log")
+	}
+	s.index[msg.UUID] = logEntry{offset: s.end, length: int64(len(data))}
+	s.order = append(s.order, msg.UUID)
+	s.end += int64(len(data))
+	return nil
+}
+
+func (s *LogStore) Each(f func(*Message)) error {
+	s.RLock()
+	order := make([]string, len(s.order))
+	copy(order, s.order)
+	s.RUnlock()
+	for _, id := range order {
+		s.RLock()
+		msg, err := s.read(s.index[id])
+		s.RUnlock()
+		if err != nil {
+			return err
+		}
+		f(msg)
+	}
+	return nil
+}
+
+func (s *LogStore) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	if err := s.file.Sync(); err != nil {
+		s.file.Close()
+		return errors.Wrapf(err, "Unable to save message log")
+	}
+	return s.file.Close()
+}
@@ -1,9 +1,31 @@
 package messages
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+	"time"
+
 	uuid "github.com/nu7hatch/gouuid"
 	"github.com/pkg/errors"
-	"time"
+)
+
+// HashIDPrefix begins every message ID that is derived from the contents of
+// its message. IDs without this prefix are UUIDs and cannot be verified.
+const HashIDPrefix = "sha256:"
+
+// canonicalEncodingVersion begins the canonical encoding of every message so
+// that the encoding can be changed without creating ambiguous IDs.
+const canonicalEncodingVersion = "arbor-message-v1"
+
+// Tags that introduce the optional sections of a canonical encoding.
+const (
+	metadataTag  byte = 'm'
+	publicKeyTag byte = 'k'
 )
 
 type Message struct {
@@ -12,6 +34,19 @@ type Message struct {
 	Content   string
 	Username  string
 	Timestamp int64
+	// Depth is the number of ancestors that the message has, so a root
+	// message has depth 0. It is computed by the server and is not part
+	// of the message's canonical encoding.
+	Depth uint64
+	// Metadata holds data for client-side protocol extensions, keyed by
+	// namespaced names like "arbor/bot". The server stores and relays it
+	// without interpreting it. See SetMeta and GetMeta.
+	Metadata map[string]json.RawMessage `json:",omitempty"`
+	// PublicKey is the ed25519 public key of the message's author, and
+	// Signature is that author's signature of the message's canonical
+	// encoding. Both are optional. See Sign and VerifySignature.
+	PublicKey []byte `json:",omitempty"`
+	Signature []byte `json:",omitempty"`
 }
 
 func NewMessage(content string) (*Message, error) {
@@ -23,6 +58,7 @@ func NewMessage(content string) (*Message, error) {
 
 }
 
+// AssignID gives the message a new random UUID.
 func (m *Message) AssignID() error {
 	id, err := uuid.NewV4()
 	if err != nil {
@@ -32,6 +68,78 @@ func (m *Message) AssignID() error {
 	return nil
 }
 
+// CanonicalEncoding returns an unambiguous encoding of the message's Parent,
+// Content, Username, Timestamp, Metadata, and PublicKey. Two messages have
+// the same canonical encoding exactly when those fields are equal.
+func (m *Message) CanonicalEncoding() []byte {
+	buf := &bytes.Buffer{}
+	writeField := func(field string) {
+		binary.Write(buf, binary.BigEndian, uint32(len(field)))
+		buf.WriteString(field)
+	}
+	writeField(canonicalEncodingVersion)
+	writeField(m.Parent)
+	writeField(m.Content)
+	writeField(m.Username)
+	binary.Write(buf, binary.BigEndian, m.Timestamp)
+	// optional fields are only encoded when present so that the IDs of
+	// messages without them are unaffected. Each is preceded by a tag to
+	// distinguish it from the others.
+	if len(m.Metadata) > 0 {
+		buf.WriteByte(metadataTag)
+		keys := make([]string, 0, len(m.Metadata))
+		for key := range m.Metadata {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		binary.Write(buf, binary.BigEndian, uint32(len(keys)))
+		for _, key := range keys {
+			writeField(key)
+			writeField(string(compactMetadata(m.Metadata[key])))
+		}
+	}
+	if len(m.PublicKey) > 0 {
+		buf.WriteByte(publicKeyTag)
+		writeField(string(m.PublicKey))
+	}
+	return buf.Bytes()
+}
+
+// ComputeID returns the content-derived ID of the message, which is the
+// SHA-256 hash of its canonical encoding.
+func (m *Message) ComputeID() string {
+	sum := sha256.Sum256(m.CanonicalEncoding())
+	return HashIDPrefix + hex.EncodeToString(sum[:])
+}
+
+// AssignHashID sets the message's ID to its content-derived ID.
+func (m *Message) AssignHashID() {
+	m.UUID = m.ComputeID()
+}
+
+// HasHashID returns whether the message's ID is derived from its contents.
+func (m *Message) HasHashID() bool {
+	return IsHashID(m.UUID)
+}
+
+// IsHashID returns whether id is a content-derived message ID.
+func IsHashID(id string) bool {
+	return strings.HasPrefix(id, HashIDPrefix)
+}
+
+// VerifyID returns an error if the message has a content-derived ID that
+// does not match its contents. Messages with UUIDs cannot be checked, so
+// they are always accepted.
+func (m *Message) VerifyID() error {
+	if !m.HasHashID() {
+		return nil
+	}
+	if expected := m.ComputeID(); m.UUID != expected {
+		return errors.Errorf("Message ID %s does not match contents (expected %s)", m.UUID, expected)
+	}
+	return nil
+}
+
 func (m *Message) Reply(content string) (*Message, error) {
 	reply, err := NewMessage(content)
 	if err != nil {
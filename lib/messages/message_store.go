@@ -1,28 +1,51 @@
 package messages
 
-type Store struct {
+// Store holds a collection of messages, indexed by their IDs.
+type Store interface {
+	// Get returns the message with the given ID, or nil if there is none.
+	Get(uuid string) *Message
+	// Add stores msg. Adding a message whose ID is already present has no
+	// effect.
+	Add(msg *Message) error
+}
+
+// PersistentStore is a Store whose contents survive after it is closed.
+type PersistentStore interface {
+	Store
+	// Each calls f with every stored message, in the order that they were
+	// added.
+	Each(f func(*Message)) error
+	// Close releases the store's resources after ensuring that every
+	// added message has been saved.
+	Close() error
+}
+
+// MemoryStore is a Store that holds messages in memory.
+type MemoryStore struct {
 	m        map[string]*Message
 	add      chan *Message
 	request  chan string
 	response chan *Message
 }
 
-func NewStore() *Store {
-	s := &Store{
-		m: make(map[string]*Message),
-		add: make(chan *Message),
-		request: make(chan string),
+func NewStore() *MemoryStore {
+	s := &MemoryStore{
+		m:        make(map[string]*Message),
+		add:      make(chan *Message),
+		request:  make(chan string),
 		response: make(chan *Message),
 	}
 	go s.dispatch()
 	return s
 }
 
-func (s *Store) dispatch() {
+func (s *MemoryStore) dispatch() {
 	for {
 		select {
 		case msg := <-s.add:
-			s.m[msg.UUID] = msg
+			if _, exists := s.m[msg.UUID]; !exists {
+				s.m[msg.UUID] = msg
+			}
 		case id := <-s.request:
 			value, _ := s.m[id]
 			s.response <- value
@@ -30,11 +53,12 @@ func (s *Store) dispatch() {
 	}
 }
 
-func (s *Store) Get(uuid string) *Message {
+func (s *MemoryStore) Get(uuid string) *Message {
 	s.request <- uuid
 	return <-s.response
 }
 
-func (s *Store) Add(msg *Message) {
+func (s *MemoryStore) Add(msg *Message) error {
 	s.add <- msg
+	return nil
 }
@@ -0,0 +1,152 @@
+package messages
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"regexp"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// MaxMetadataEntries is the largest number of metadata keys a message may have.
+	MaxMetadataEntries = 32
+	// MaxMetadataKeyLength is the longest permitted metadata key, in bytes.
+	MaxMetadataKeyLength = 128
+	// MaxMetadataSize is the largest permitted total size of a message's
+	// metadata keys and JSON-encoded values, in bytes.
+	MaxMetadataSize = 8192
+)
+
+// RoomKey is the metadata key that marks a message as the root of a room. Its
+// value is the name of the room.
+const RoomKey = "arbor/room"
+
+// metadataKeyPattern matches valid metadata keys, which consist of a
+// namespace and a name separated by a slash, such as "arbor/bot". Each
+// extension should use a namespace that it controls, like a domain name.
+var metadataKeyPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9.-]*/[A-Za-z0-9._-]+$`)
+
+// ValidMetadataKey returns whether key may be used as a metadata key.
+func ValidMetadataKey(key string) bool {
+	return len(key) <= MaxMetadataKeyLength && metadataKeyPattern.MatchString(key)
+}
+
+// ValidateMetadata returns an error if the message's metadata has invalid
+// keys or values, or exceeds the size limits.
+func (m *Message) ValidateMetadata() error {
+	if len(m.Metadata) > MaxMetadataEntries {
+		return errors.Errorf("Message has %d metadata entries, limit is %d", len(m.Metadata), MaxMetadataEntries)
+	}
+	size := 0
+	for key, value := range m.Metadata {
+		if !ValidMetadataKey(key) {
+			return errors.Errorf("Invalid metadata key %q", key)
+		}
+		if !json.Valid(value) {
+			return errors.Errorf("Metadata value for %q is not valid JSON", key)
+		}
+		size += len(key) + len(value)
+	}
+	if size > MaxMetadataSize {
+		return errors.Errorf("Message has %d bytes of metadata, limit is %d", size, MaxMetadataSize)
+	}
+	return nil
+}
+
+// SetMeta stores the JSON encoding of value in the message's metadata
+// under key.
+func (m *Message) SetMeta(key string, value interface{}) error {
+	if !ValidMetadataKey(key) {
+		return errors.Errorf("Invalid metadata key %q", key)
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return errors.Wrapf(err, "Unable to encode metadata value for %q", key)
+	}
+	if m.Metadata == nil {
+		m.Metadata = make(map[string]json.RawMessage)
+	}
+	m.Metadata[key] = data
+	return nil
+}
+
+// GetMeta decodes the metadata stored under key into value, which should
+// be a pointer. It returns false if the message has no metadata for key.
+func (m *Message) GetMeta(key string, value interface{}) (bool, error) {
+	data, ok := m.Metadata[key]
+	if !ok {
+		return false, nil
+	}
+	if err := json.Unmarshal(data, value); err != nil {
+		return true, errors.Wrapf(err, "Unable to decode metadata value for %q", key)
+	}
+	return true, nil
+}
+
+// DeleteMeta removes any metadata stored under key.
+func (m *Message) DeleteMeta(key string) {
+	delete(m.Metadata, key)
+}
+
+// compactMetadata returns value with insignificant whitespace removed, so
+// that equivalent encodings of a metadata value are treated identically.
+func compactMetadata(value json.RawMessage) []byte {
+	buf := &bytes.Buffer{}
+	if err := json.Compact(buf, value); err != nil {
+		return value
+	}
+	return buf.Bytes()
+}
+
+var (
+	extensionsLock sync.RWMutex
+	extensions     = make(map[string]reflect.Type)
+)
+
+// RegisterExtension associates a metadata key with the type of prototype,
+// so that Extensions can decode the values stored under that key. It is
+// intended to be called during program initialization.
+func RegisterExtension(key string, prototype interface{}) error {
+	if !ValidMetadataKey(key) {
+		return errors.Errorf("Invalid metadata key %q", key)
+	}
+	t := reflect.TypeOf(prototype)
+	if t == nil {
+		return errors.Errorf("Extension %q has no type", key)
+	}
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	extensionsLock.Lock()
+	defer extensionsLock.Unlock()
+	if _, exists := extensions[key]; exists {
+		return errors.Errorf("Extension %q is already registered", key)
+	}
+	extensions[key] = t
+	return nil
+}
+
+// Extensions decodes every metadata value on the message whose key has been
+// registered with RegisterExtension. The result maps each key to a pointer
+// to a value of the registered type. Keys that are not registered are
+// ignored, and values that cannot be decoded cause an error.
+func (m *Message) Extensions() (map[string]interface{}, error) {
+	extensionsLock.RLock()
+	defer extensionsLock.RUnlock()
+	result := make(map[string]interface{})
+	for key, data := range m.Metadata {
+		t, ok := extensions[key]
+		if !ok {
+			continue
+		}
+		value := reflect.New(t).Interface()
+		if err := json.Unmarshal(data, value); err != nil {
+			return nil, errors.Wrapf(err, "Unable to decode extension %q", key)
+		}
+		result[key] = value
+	}
+	return result, nil
+}
@@ -0,0 +1,159 @@
+package messages
+
+import (
+	"strconv"
+	"sync"
+)
+
+// Requester assigns request IDs to the requests that a client sends to a
+// server and matches the server's responses back to them. Every message
+// read from the server should be passed to Handle. Handle and Close must be
+// called from the same goroutine, usually the one reading from the server.
+type Requester struct {
+	out chan<- *ArborMessage
+	// stopped is set once out has been closed, and outLock is held while
+	// writing to out so that it is never closed during a write
+	stopped bool
+	outLock sync.RWMutex
+	next    uint64
+	pending map[string]*pendingRequest
+	closed  bool
+	sync.Mutex
+}
+
+type pendingRequest struct {
+	request   *ArborMessage
+	responses chan *ArborMessage
+	// cancelled is closed once the caller no longer wants the responses
+	cancelled chan struct{}
+}
+
+// NewRequester creates a Requester that writes requests to out.
+func NewRequester(out chan<- *ArborMessage) *Requester {
+	return &Requester{
+		out:     out,
+		pending: make(map[string]*pendingRequest),
+	}
+}
+
+// Send writes msg to the server without expecting a response.
+// Messages sent after Stop are discarded.
+func (r *Requester) Send(msg *ArborMessage) {
+	r.outLock.RLock()
+	defer r.outLock.RUnlock()
+	if !r.stopped {
+		r.out <- msg
+	}
+}
+
+// Stop closes the channel that the Requester writes to, once the messages
+// being sent have been written to it, so that whatever reads the channel can
+// finish. Since it waits for those writes, it should only be called once the
+// reader cannot block, as with a writer whose connection has been closed.
+func (r *Requester) Stop() {
+	r.outLock.Lock()
+	defer r.outLock.Unlock()
+	if !r.stopped {
+		r.stopped = true
+		close(r.out)
+	}
+}
+
+// Request assigns msg a new RequestID and sends it to the server. The
+// returned channel receives each response to msg and is closed once the
+// final response has arrived, or when the Requester is closed.
+func (r *Requester) Request(msg *ArborMessage) <-chan *ArborMessage {
+	responses := make(chan *ArborMessage, 1)
+	r.Lock()
+	if r.closed {
+		r.Unlock()
+		close(responses)
+		return responses
+	}
+	r.next++
+	msg.RequestID = strconv.FormatUint(r.next, 10)
+	r.pending[msg.RequestID] = &pendingRequest{
+		request:   msg,
+		responses: responses,
+		cancelled: make(chan struct{}),
+	}
+	r.Unlock()
+	r.Send(msg)
+	return responses
+}
+
+// Query requests the message with the given id. See Request.
+func (r *Requester) Query(id string) <-chan *ArborMessage {
+	return r.Request(&ArborMessage{
+		Type:    QUERY,
+		Message: &Message{UUID: id},
+	})
+}
+
+// Handle delivers msg to the request that it answers. It returns false if
+// msg is not a response to any outstanding request.
+func (r *Requester) Handle(msg *ArborMessage) bool {
+	if msg.RequestID == "" {
+		return false
+	}
+	r.Lock()
+	pending, ok := r.pending[msg.RequestID]
+	final := ok && isFinalResponse(pending.request, msg)
+	if final {
+		delete(r.pending, msg.RequestID)
+	}
+	r.Unlock()
+	if !ok {
+		return false
+	}
+	select {
+	case pending.responses <- msg:
+	case <-pending.cancelled:
+		return true
+	}
+	if final {
+		close(pending.responses)
+	}
+	return true
+}
+
+// Cancel abandons the outstanding request with the given RequestID, whose
+// channel receives no further responses and is never closed. Handle does not
+// recognize responses to it that arrive later.
+func (r *Requester) Cancel(id string) {
+	r.Lock()
+	defer r.Unlock()
+	if pending, ok := r.pending[id]; ok {
+		delete(r.pending, id)
+		close(pending.cancelled)
+	}
+}
+
+// Close abandons every outstanding request, closing their channels. It
+// should be called once no more messages will be read from the server.
+func (r *Requester) Close() {
+	r.Lock()
+	defer r.Unlock()
+	r.closed = true
+	for id, pending := range r.pending {
+		close(pending.responses)
+		delete(r.pending, id)
+	}
+}
+
+// isFinalResponse returns whether response is the last message that the
+// server will send in reply to request.
+func isFinalResponse(request, response *ArborMessage) bool {
+	if response.Type == ERROR || response.Type == DONE {
+		return true
+	}
+	switch request.Type {
+	case QUERY:
+		return response.Type == NEW_MESSAGE
+	case JOIN, LEAVE, LIST_ROOMS, PEER:
+		return response.Type == request.Type
+	case PING:
+		return response.Type == PONG
+	}
+	return false
+}
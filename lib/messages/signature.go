@@ -0,0 +1,60 @@
+package messages
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+)
+
+// SignatureStatus describes whether a message's signature can be trusted.
+type SignatureStatus uint8
+
+const (
+	// Unverified means that the message is not signed, so nothing is known
+	// about its author.
+	Unverified SignatureStatus = 0
+	// Verified means that the message was signed by the holder of the
+	// private key corresponding to its PublicKey.
+	Verified SignatureStatus = 1
+	// Invalid means that the message has a signature or public key, but the
+	// signature does not match the message.
+	Invalid SignatureStatus = 2
+)
+
+func (s SignatureStatus) String() string {
+	switch s {
+	case Verified:
+		return "verified"
+	case Invalid:
+		return "invalid"
+	}
+	return "unverified"
+}
+
+// Sign sets the message's PublicKey to the public half of key and signs the
+// message's canonical encoding. The message must not be modified afterward.
+func (m *Message) Sign(key ed25519.PrivateKey) {
+	m.PublicKey = key.Public().(ed25519.PublicKey)
+	m.Signature = ed25519.Sign(key, m.CanonicalEncoding())
+}
+
+// VerifySignature checks the message's signature against its PublicKey.
+func (m *Message) VerifySignature() SignatureStatus {
+	if len(m.PublicKey) == 0 && len(m.Signature) == 0 {
+		return Unverified
+	}
+	if len(m.PublicKey) != ed25519.PublicKeySize || len(m.Signature) != ed25519.SignatureSize {
+		return Invalid
+	}
+	if !ed25519.Verify(ed25519.PublicKey(m.PublicKey), m.CanonicalEncoding(), m.Signature) {
+		return Invalid
+	}
+	return Verified
+}
+
+// KeyFingerprint returns a short string identifying a public key, suitable
+// for displaying to users.
+func KeyFingerprint(key []byte) string {
+	sum := sha256.Sum256(key)
+	return hex.EncodeToString(sum[:8])
+}
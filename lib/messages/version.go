@@ -0,0 +1,88 @@
+package messages
+
+import "fmt"
+
+// Version identifies a revision of the Arbor protocol.
+type Version struct {
+	Major uint8
+	Minor uint8
+}
+
+var (
+	// Version0_1 is the original protocol, which has no version negotiation.
+	// It is assumed on every connection until a different version is agreed.
+	Version0_1 = Version{Major: 0, Minor: 1}
+	// Version0_2 adds version negotiation through VERSION messages, ERROR
+	// messages, tree queries, SHUTDOWN notices, rooms, PING and PONG
+	// keepalives, SYNC summaries, REPLICATE streams, RESUME requests, and PEER
+	// handshakes.
+	Version0_2 = Version{Major: 0, Minor: 2}
+)
+
+// SupportedVersions lists every protocol version that this package can speak,
+// from newest to oldest.
+var SupportedVersions = []Version{Version0_2, Version0_1}
+
+// CurrentVersion returns the newest protocol version that this package can speak.
+func CurrentVersion() Version {
+	return SupportedVersions[0]
+}
+
+// introducedIn records the protocol version in which each message type was
+// first defined. Types that are absent were part of version 0.1.
+var introducedIn = map[ArborMessageType]Version{
+	ERROR:      Version0_2,
+	ANCESTRY:   Version0_2,
+	CHILDREN:   Version0_2,
+	SUBTREE:    Version0_2,
+	DONE:       Version0_2,
+	SHUTDOWN:   Version0_2,
+	JOIN:       Version0_2,
+	LEAVE:      Version0_2,
+	LIST_ROOMS: Version0_2,
+	PING:       Version0_2,
+	PONG:       Version0_2,
+	SYNC:       Version0_2,
+	REPLICATE:  Version0_2,
+	RESUME:     Version0_2,
+	PEER:       Version0_2,
+}
+
+func (v Version) String() string {
+	return fmt.Sprintf("%d.%d", v.Major, v.Minor)
+}
+
+// Less returns whether v is an older protocol version than other.
+func (v Version) Less(other Version) bool {
+	if v.Major != other.Major {
+		return v.Major < other.Major
+	}
+	return v.Minor < other.Minor
+}
+
+// Supports returns whether messages of the given type may be exchanged on a
+// connection using protocol version v. VERSION messages are always permitted
+// so that a version can be negotiated.
+func (v Version) Supports(t ArborMessageType) bool {
+	if t == VERSION {
+		return true
+	}
+	introduced, ok := introducedIn[t]
+	if !ok {
+		return true
+	}
+	return !v.Less(introduced)
+}
+
+// Negotiate chooses the newest version that appears both in offered and in
+// SupportedVersions. If there is no such version, ok will be false.
+func Negotiate(offered []Version) (chosen Version, ok bool) {
+	for _, supported := range SupportedVersions {
+		for _, candidate := range offered {
+			if candidate == supported {
+				return supported, true
+			}
+		}
+	}
+	return Version{}, false
+}
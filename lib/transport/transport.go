@@ -0,0 +1,191 @@
+// Package transport establishes the connections that Arbor messages are sent
+// over, which are either plain TCP or TCP secured with TLS.
+package transport
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"flag"
+	"io/ioutil"
+	"log"
+	"net"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Fingerprint returns the SHA-256 hash of the DER encoding of cert as a hex
+// string. This is the form expected by ClientConfig.Fingerprint.
+func Fingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	return hex.EncodeToString(sum[:])
+}
+
+// normalizeFingerprint converts a fingerprint written with upper case letters
+// or colon separators (as printed by many tools) into the form returned by
+// Fingerprint.
+func normalizeFingerprint(fingerprint string) string {
+	return strings.ToLower(strings.Replace(fingerprint, ":", "", -1))
+}
+
+// ServerConfig describes how a server accepts connections.
+type ServerConfig struct {
+	// CertFile and KeyFile are the paths of the PEM-encoded certificate and
+	// private key presented to clients. If both are empty, TLS is not used.
+	CertFile string
+	KeyFile  string
+	// ClientCAFile is the path of a PEM-encoded bundle of certificate
+	// authorities. If it is set, clients must present a certificate signed
+	// by one of them.
+	ClientCAFile string
+}
+
+// AddServerFlags defines command line flags that fill the returned
+// ServerConfig once fs has been parsed.
+func AddServerFlags(fs *flag.FlagSet) *ServerConfig {
+	config := &ServerConfig{}
+	fs.StringVar(&config.CertFile, "tls-cert", "", "PEM certificate file, enables TLS when set along with -tls-key")
+	fs.StringVar(&config.KeyFile, "tls-key", "", "PEM private key file for -tls-cert")
+	fs.StringVar(&config.ClientCAFile, "tls-client-ca", "", "PEM file of CAs that client certificates must be signed by (client certificates are not required if empty)")
+	return config
+}
+
+// Enabled returns whether connections should use TLS.
+func (c *ServerConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != ""
+}
+
+// Listen listens for connections on the TCP address, using TLS if the
+// configuration enables it.
+func Listen(address string, config *ServerConfig) (net.Listener, error) {
+	if !config.Enabled() {
+		if config.ClientCAFile != "" {
+			return nil, errors.New("A client CA requires a TLS certificate and key")
+		}
+		return net.Listen("tcp", address)
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to load TLS certificate")
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientCAFile != "" {
+		pool, err := loadCertPool(config.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	if leaf, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+		log.Println("TLS certificate fingerprint is", Fingerprint(leaf))
+	}
+	return tls.Listen("tcp", address, tlsConfig)
+}
+
+// ClientConfig describes how a client connects to a server.
+type ClientConfig struct {
+	// TLS enables TLS. It is implied by every other field.
+	TLS bool
+	// Fingerprint, if set, is the only server certificate that will be
+	// accepted (see the Fingerprint function). The certificate need not be
+	// signed by a trusted authority.
+	Fingerprint string
+	// AllowSelfSigned accepts any server certificate without verifying it.
+	// It is only intended for development.
+	AllowSelfSigned bool
+	// CertFile and KeyFile are the paths of a PEM-encoded certificate and
+	// private key to present to servers that require one.
+	CertFile string
+	KeyFile  string
+}
+
+// AddClientFlags defines command line flags that fill the returned
+// ClientConfig once fs has been parsed.
+func AddClientFlags(fs *flag.FlagSet) *ClientConfig {
+	return AddPrefixedClientFlags(fs, "")
+}
+
+// AddPrefixedClientFlags is like AddClientFlags, but begins the name of each
+// flag with prefix so that they can be defined alongside the server's flags.
+func AddPrefixedClientFlags(fs *flag.FlagSet, prefix string) *ClientConfig {
+	config := &ClientConfig{}
+	fs.BoolVar(&config.TLS, prefix+"tls", false, "connect using TLS")
+	fs.StringVar(&config.Fingerprint, prefix+"tls-pin", "", "SHA-256 fingerprint of the only server certificate to accept")
+	fs.BoolVar(&config.AllowSelfSigned, prefix+"tls-allow-self-signed", false, "accept any server certificate without verifying it (for development only)")
+	fs.StringVar(&config.CertFile, prefix+"tls-cert", "", "PEM certificate file to present to the server")
+	fs.StringVar(&config.KeyFile, prefix+"tls-key", "", "PEM private key file for -"+prefix+"tls-cert")
+	return config
+}
+
+// Enabled returns whether connections should use TLS.
+func (c *ClientConfig) Enabled() bool {
+	return c.TLS || c.Fingerprint != "" || c.AllowSelfSigned || c.CertFile != "" || c.KeyFile != ""
+}
+
+// Dial connects to the TCP address, using TLS if the configuration enables
+// it.
+func Dial(address string, config *ClientConfig) (net.Conn, error) {
+	if !config.Enabled() {
+		return net.Dial("tcp", address)
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Invalid address %s", address)
+	}
+	tlsConfig := &tls.Config{
+		ServerName: host,
+		MinVersion: tls.VersionTLS12,
+	}
+	if config.CertFile != "" || config.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+		if err != nil {
+			return nil, errors.Wrapf(err, "Unable to load TLS client certificate")
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if config.Fingerprint != "" {
+		// the pinned fingerprint replaces the usual verification
+		// against trusted authorities
+		pinned := normalizeFingerprint(config.Fingerprint)
+		tlsConfig.InsecureSkipVerify = true
+		tlsConfig.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return errors.New("Server presented no certificate")
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return errors.Wrapf(err, "Unable to parse server certificate")
+			}
+			if actual := Fingerprint(leaf); actual != pinned {
+				return errors.Errorf("Server certificate fingerprint %s does not match pinned fingerprint %s", actual, pinned)
+			}
+			return nil
+		}
+	} else if config.AllowSelfSigned {
+		log.Println("Warning: server certificate will not be verified")
+		tlsConfig.InsecureSkipVerify = true
+	}
+	return tls.Dial("tcp", address, tlsConfig)
+}
+
+// loadCertPool reads a bundle of PEM-encoded certificates from path.
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrapf(err, "Unable to read certificates")
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.Errorf("No certificates found in %s", path)
+	}
+	return pool, nil
+}